@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/evennode/vault-plugin-secrets-oauth-client-credentials/pkg/backend"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
@@ -13,8 +14,20 @@ func main() {
 	meta := &api.PluginAPIClientMeta{}
 
 	flags := meta.FlagSet()
+	statsdAddr := flags.String("statsd-address", "", "Address of a statsd server to send metrics to")
 	flags.Parse(os.Args[1:])
 
+	// Plugins run in their own process, so metrics don't reach the sinks
+	// configured for Vault and need a sink of their own.
+	if *statsdAddr != "" {
+		if err := setupMetrics(*statsdAddr); err != nil {
+			logger := hclog.New(&hclog.LoggerOptions{})
+
+			logger.Error("failed to set up metrics", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	err := plugin.Serve(&plugin.ServeOpts{
 		BackendFactoryFunc: backend.Factory,
 		TLSProviderFunc:    api.VaultPluginTLSProvider(meta.GetTLSConfig()),
@@ -26,3 +39,16 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func setupMetrics(statsdAddr string) error {
+	sink, err := metrics.NewStatsdSink(statsdAddr)
+	if err != nil {
+		return err
+	}
+
+	conf := metrics.DefaultConfig("vault")
+	conf.EnableHostname = false
+
+	_, err = metrics.NewGlobal(conf, sink)
+	return err
+}
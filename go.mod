@@ -3,9 +3,13 @@ module github.com/evennode/vault-plugin-secrets-oauth-client-credentials
 go 1.15
 
 require (
+	github.com/armon/go-metrics v0.3.3
 	github.com/hashicorp/go-hclog v0.14.1
+	github.com/hashicorp/go-uuid v1.0.1
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/hashicorp/vault/sdk v0.1.14-0.20190909201848-e0fbf9b652e2
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
@@ -2,17 +2,33 @@ package backend
 
 import (
 	"context"
+	"net/http"
 	"strings"
 	"sync"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/salt"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
 )
 
 type backend struct {
-	credMut sync.Mutex
-	logger  hclog.Logger
+	credLocks []*locksutil.LockEntry
+	dpopMut   sync.Mutex
+	eventsMut sync.Mutex
+	saltMut   sync.RWMutex
+	salt      *salt.Salt
+	logger    hclog.Logger
+	breaker   *circuitBreaker
+	limiter   *rateLimiter
+	metrics   metricsEmitter
+	status    *fetchStatus
+	system    func() logical.SystemView
+	clock     Clock
+	transport func() http.RoundTripper
 }
 
 const backendHelp = `
@@ -20,33 +36,125 @@ The OAuth client credentials app backend provides OAuth authorization
 tokens using client credentials grant type based on secret client configuration.
 `
 
-type options struct {
-	Logger hclog.Logger
+// Options customize a backend created by NewFactory. Zero values use the
+// defaults of Factory.
+type Options struct {
+	Logger  hclog.Logger
+	Metrics *metrics.Metrics
+
+	// Clock replaces the system clock for token expiries, the circuit
+	// breaker, rate limits, DPoP proofs, assertions and retry delays.
+	Clock Clock
+
+	// Transport returns the transport of HTTP clients sending requests to
+	// the provider and, for the proxy endpoint, to resource servers.
+	Transport func() http.RoundTripper
 }
 
-func new(opts options) *framework.Backend {
+func new(opts Options) *framework.Backend {
 	logger := opts.Logger
 	if logger == nil {
 		logger = hclog.NewNullLogger()
 	}
 
 	b := &backend{
-		logger: logger,
+		credLocks: locksutil.CreateLocks(),
+		logger:    logger,
+		breaker:   &circuitBreaker{},
+		limiter:   &rateLimiter{},
+		metrics:   globalMetrics{},
+		status:    &fetchStatus{},
+		clock:     systemClock{},
+		transport: defaultTransport,
+	}
+
+	if opts.Metrics != nil {
+		b.metrics = opts.Metrics
+	}
+
+	if opts.Clock != nil {
+		b.clock = opts.Clock
+	}
+
+	if opts.Transport != nil {
+		b.transport = opts.Transport
 	}
 
-	return &framework.Backend{
-		Help:         strings.TrimSpace(backendHelp),
-		PathsSpecial: pathsSpecial(),
-		Paths:        paths(b),
-		BackendType:  logical.TypeLogical,
+	fb := &framework.Backend{
+		Help:           strings.TrimSpace(backendHelp),
+		PathsSpecial:   pathsSpecial(),
+		Paths:          paths(b),
+		BackendType:    logical.TypeLogical,
+		InitializeFunc: b.initialize,
+		PeriodicFunc:   b.periodic,
+		Invalidate:     b.invalidate,
 	}
+	b.system = fb.System
+
+	return fb
 }
 
 // Factory creates a new backend
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	b := new(options{Logger: conf.Logger})
+	return factory(ctx, conf, Options{})
+}
+
+// NewFactory returns a factory creating backends with the given options, e.g.
+// to embed the backend with another clock or transport.
+func NewFactory(opts Options) logical.Factory {
+	return func(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
+		return factory(ctx, conf, opts)
+	}
+}
+
+// factory creates a new backend with the given options, logging to the logger
+// of conf unless another one is given.
+func factory(ctx context.Context, conf *logical.BackendConfig, opts Options) (logical.Backend, error) {
+	if opts.Logger == nil {
+		opts.Logger = conf.Logger
+	}
+
+	b := new(opts)
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
+
+func defaultTransport() http.RoundTripper {
+	return http.DefaultTransport
+}
+
+// httpClient returns a new HTTP client for requests to the provider and
+// resource servers.
+func (b *backend) httpClient() *http.Client {
+	return &http.Client{Transport: b.transport()}
+}
+
+// lockToken locks the token stored under key, so that a single request
+// replaces it at a time. Tokens are locked separately, so that a slow or
+// failing token request doesn't hold up requests for other tokens.
+func (b *backend) lockToken(key string) func() {
+	l := locksutil.LockForKey(b.credLocks, key)
+	l.Lock()
+	return l.Unlock
+}
+
+// lockAllTokens locks all tokens, e.g. while upgrading storage.
+func (b *backend) lockAllTokens() func() {
+	for _, l := range b.credLocks {
+		l.Lock()
+	}
+
+	return func() {
+		for _, l := range b.credLocks {
+			l.Unlock()
+		}
+	}
+}
+
+// clientContext returns a context whose HTTP client is used for token
+// requests.
+func clientContext(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
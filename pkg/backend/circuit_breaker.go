@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker tracks consecutive upstream failures and fast-fails token
+// requests for a cooldown period once the configured threshold is reached.
+// After the cooldown a single trial request is let through; its outcome
+// either closes or re-opens the circuit.
+type circuitBreaker struct {
+	mut      sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow reports whether a token request may be sent upstream at the given
+// time.
+func (cb *circuitBreaker) allow(threshold int, cooldown time.Duration, now time.Time) bool {
+	if threshold <= 0 {
+		return true
+	}
+
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+
+	if cb.openedAt.IsZero() {
+		return true
+	}
+
+	if cb.trial || now.Sub(cb.openedAt) < cooldown {
+		return false
+	}
+
+	cb.trial = true
+	return true
+}
+
+func (cb *circuitBreaker) success() {
+	cb.reset()
+}
+
+func (cb *circuitBreaker) failure(threshold int, now time.Time) {
+	if threshold <= 0 {
+		return
+	}
+
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+
+	cb.failures++
+	if cb.trial || cb.failures >= threshold {
+		cb.openedAt = now
+	}
+	cb.trial = false
+}
+
+// release ends a trial request that was never sent upstream, so that it
+// tells nothing about the token endpoint and the next request is let through
+// as a trial instead.
+func (cb *circuitBreaker) release() {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+
+	cb.failures = 0
+	cb.openedAt = time.Time{}
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) state(threshold int, cooldown time.Duration, now time.Time) string {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+
+	switch {
+	case threshold <= 0 || cb.openedAt.IsZero():
+		return circuitClosed
+	case cb.trial || now.Sub(cb.openedAt) >= cooldown:
+		return circuitHalfOpen
+	default:
+		return circuitOpen
+	}
+}
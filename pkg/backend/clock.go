@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time that token expiries, the circuit breaker, rate limits,
+// DPoP proofs and assertions are computed and checked with, and waits between
+// token request retries and for the rate limit.
+type Clock interface {
+	Now() time.Time
+
+	// Sleep waits for d to pass or ctx to be done, returning the error of
+	// ctx in the latter case.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/logical"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	dpopKeysPath       = "dpop-keys"
+	dpopKeysPathPrefix = dpopKeysPath + "/"
+
+	dpopHeader      = "DPoP"
+	dpopNonceHeader = "DPoP-Nonce"
+	dpopProofType   = "dpop+jwt"
+)
+
+// dpopKey is the stored DPoP key pair of a credential.
+type dpopKey struct {
+	PrivateKey []byte `json:"private_key"`
+}
+
+// dpopKeyPath returns the storage key of the DPoP key pair for the credential
+// name.
+func dpopKeyPath(s *salt.Salt, name string) string {
+	return hashedKey(s, dpopKeysPathPrefix, name)
+}
+
+// getDPoPKey returns the DPoP key pair stored under key, generating and
+// storing a new one if there is none yet.
+func (b *backend) getDPoPKey(ctx context.Context, storage logical.Storage, key string) (*ecdsa.PrivateKey, error) {
+	b.dpopMut.Lock()
+	defer b.dpopMut.Unlock()
+
+	entry, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	} else if entry != nil {
+		dk := &dpopKey{}
+		if err := entry.DecodeJSON(dk); err != nil {
+			return nil, err
+		}
+
+		return x509.ParseECPrivateKey(dk.PrivateKey)
+	}
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err = logical.StorageEntryJSON(key, &dpopKey{PrivateKey: der})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return pk, nil
+}
+
+// dpopClaims are the claims of a DPoP proof as defined in RFC 9449.
+type dpopClaims struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// dpopProof returns a DPoP proof issued at the given time for a request with
+// the given method and URL signed by pk. If an access token is given, the
+// proof is bound to it.
+func dpopProof(pk *ecdsa.PrivateKey, method, target, nonce, accessToken string, now time.Time) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	// The proof covers the URL without query and fragment.
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	jti := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, jti); err != nil {
+		return "", err
+	}
+
+	claims := &dpopClaims{
+		ID:       hex.EncodeToString(jti),
+		Method:   method,
+		URL:      u.String(),
+		IssuedAt: now.Unix(),
+		Nonce:    nonce,
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.AccessTokenHash = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: pk}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return jws.CompactSerialize()
+}
+
+// dpopTransport adds a DPoP proof to every request, bound to the access token
+// if one is set. If the server asks for a nonce, the request is repeated once
+// with a proof including it.
+type dpopTransport struct {
+	key         *ecdsa.PrivateKey
+	accessToken string
+	next        http.RoundTripper
+	clock       Clock
+}
+
+func (t *dpopTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(r, "")
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := resp.Header.Get(dpopNonceHeader)
+	if nonce == "" || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized) {
+		return resp, nil
+	} else if r.Body != nil && r.GetBody == nil {
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		r = r.Clone(r.Context())
+		r.Body = body
+	}
+
+	return t.roundTrip(r, nonce)
+}
+
+func (t *dpopTransport) roundTrip(r *http.Request, nonce string) (*http.Response, error) {
+	proof, err := dpopProof(t.key, r.Method, r.URL.String(), nonce, t.accessToken, t.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	r = r.Clone(r.Context())
+	r.Header.Set(dpopHeader, proof)
+
+	return t.next.RoundTrip(r)
+}
+
+// dpopClient returns a copy of c that sends DPoP proofs signed by pk and
+// issued at the time told by clk.
+func dpopClient(c *http.Client, pk *ecdsa.PrivateKey, accessToken string, clk Clock) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	dc := *c
+	dc.Transport = &dpopTransport{key: pk, accessToken: accessToken, next: next, clock: clk}
+
+	return &dc
+}
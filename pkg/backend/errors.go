@@ -3,5 +3,31 @@ package backend
 import "errors"
 
 var (
-	errInvalidCredentials = errors.New("invalid client credentials")
+	errInvalidCredentials       = errors.New("invalid client credentials")
+	errTokenEndpointUnavailable = errors.New("token endpoint unavailable")
+	errCircuitOpen              = errors.New("token endpoint circuit breaker is open")
+	errTokenRequestTimeout      = errors.New("token request timed out")
+	errRateLimited              = errors.New("token request rate limit exceeded")
+	errRefreshTokenRejected     = errors.New("refresh token rejected")
+	errInvalidAssertion         = errors.New("invalid assertion")
+	errAssertionSubjectMismatch = errors.New("assertion subject does not match entity")
+	errAssertionAudience        = errors.New("assertion audience does not match")
+	errProxyRequestFailed       = errors.New("proxied request failed")
+	errProxyResponseTooLarge    = errors.New("proxied response too large")
 )
+
+// upstreamError is returned for failed token requests. It keeps the error
+// code reported by the token endpoint alongside the error returned to the
+// client.
+type upstreamError struct {
+	err  error
+	code string
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
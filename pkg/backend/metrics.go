@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"golang.org/x/oauth2"
+)
+
+// metricsEmitter is the subset of go-metrics used by the backend. It is
+// satisfied by *metrics.Metrics so that tests can collect metrics in memory.
+type metricsEmitter interface {
+	IncrCounterWithLabels(key []string, val float32, labels []metrics.Label)
+	MeasureSinceWithLabels(key []string, start time.Time, labels []metrics.Label)
+}
+
+// globalMetrics emits to the global go-metrics instance, which discards
+// metrics unless the plugin binary is started with a sink to send them to.
+type globalMetrics struct{}
+
+func (globalMetrics) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	metrics.IncrCounterWithLabels(key, val, labels)
+}
+
+func (globalMetrics) MeasureSinceWithLabels(key []string, start time.Time, labels []metrics.Label) {
+	metrics.MeasureSinceWithLabels(key, start, labels)
+}
+
+// metricLabels returns the labels identifying the mount and the provider
+// behind the configured token URL.
+func metricLabels(mount string, c *config) []metrics.Label {
+	provider := c.TokenURL
+	if u, err := url.Parse(c.TokenURL); err == nil && u.Host != "" {
+		provider = u.Host
+	}
+
+	return []metrics.Label{
+		{Name: "mount", Value: mount},
+		{Name: "provider", Value: provider},
+	}
+}
+
+// withLabel returns a copy of labels with an additional label.
+func withLabel(labels []metrics.Label, name, value string) []metrics.Label {
+	l := make([]metrics.Label, len(labels), len(labels)+1)
+	copy(l, labels)
+	return append(l, metrics.Label{Name: name, Value: value})
+}
+
+// errorCode classifies a failed token request, preferring the OAuth error
+// code returned by the token endpoint.
+func errorCode(err error) string {
+	var upErr *upstreamError
+	var rErr *oauth2.RetrieveError
+	var uErr *url.Error
+
+	switch {
+	case errors.As(err, &upErr):
+		return upErr.code
+	case errors.As(err, &rErr):
+		if code := oauthErrorCode(rErr); code != "" {
+			return code
+		}
+		return fmt.Sprintf("http_%d", rErr.Response.StatusCode)
+	case err == errTokenRequestTimeout:
+		return "timeout"
+	case err == errCircuitOpen:
+		return "circuit_open"
+	case err == errRateLimited:
+		return "rate_limited"
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.As(err, &uErr):
+		return "network"
+	default:
+		return "unknown"
+	}
+}
+
+// oauthErrorCode extracts the error parameter of an RFC 6749 error response.
+func oauthErrorCode(rErr *oauth2.RetrieveError) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rErr.Body, &body); err == nil {
+		return body.Error
+	}
+
+	if vals, err := url.ParseQuery(string(rErr.Body)); err == nil {
+		return vals.Get("error")
+	}
+
+	return ""
+}
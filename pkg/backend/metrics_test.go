@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func newTestMetrics(t *testing.T) (*metrics.Metrics, *metrics.InmemSink) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+
+	m, err := metrics.New(conf, sink)
+	require.NoError(t, err)
+
+	return m, sink
+}
+
+func counterValue(sink *metrics.InmemSink, name string) int {
+	for _, intv := range sink.Data() {
+		if c, ok := intv.Counters[name]; ok {
+			return c.Count
+		}
+	}
+	return 0
+}
+
+func sampleCount(sink *metrics.InmemSink, name string) int {
+	for _, intv := range sink.Data() {
+		if s, ok := intv.Samples[name]; ok {
+			return s.Count
+		}
+	}
+	return 0
+}
+
+func TestTokenMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fail := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_scope"}`))
+			return
+		}
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	m, sink := newTestMetrics(t)
+
+	storage := &logical.InmemStorage{}
+	backend := new(Options{Metrics: m, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, backend.Setup(ctx, &logical.BackendConfig{}))
+
+	// Write new config
+	write := &logical.Request{
+		Operation:  logical.UpdateOperation,
+		Path:       configPath,
+		Storage:    storage,
+		MountPoint: "oauth2/my-provider/",
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "https://example.com/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation:  logical.ReadOperation,
+		Path:       credsPath + "/user",
+		Storage:    storage,
+		MountPoint: "oauth2/my-provider/",
+	}
+
+	// Cache miss fetches a new token
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	// Cache hit
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	// Failed fetch
+	fail = true
+	read.Path = credsPath + "/user2"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid client credentials")
+
+	labels := ";mount=oauth2/my-provider/;provider=example.com"
+	require.Equal(t, 2, counterValue(sink, "oauth.token.cache"+labels+";result=miss"))
+	require.Equal(t, 1, counterValue(sink, "oauth.token.cache"+labels+";result=hit"))
+	require.Equal(t, 1, counterValue(sink, "oauth.token.error"+labels+";error=invalid_scope"))
+	require.Equal(t, 2, sampleCount(sink, "oauth.token.request"+labels))
+	require.Equal(t, 2, sampleCount(sink, "oauth.token.lock_wait"+labels))
+	require.Equal(t, 3, sampleCount(sink, "oauth.creds.read"+labels))
+}
+
+func TestErrorCode(t *testing.T) {
+	retrieveError := func(contentType, body string) error {
+		return &oauth2.RetrieveError{
+			Response: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Header:     http.Header{"Content-Type": []string{contentType}},
+			},
+			Body: []byte(body),
+		}
+	}
+
+	require.Equal(t, "invalid_client", errorCode(retrieveError("application/json", `{"error":"invalid_client"}`)))
+	require.Equal(t, "invalid_grant", errorCode(retrieveError("application/x-www-form-urlencoded", `error=invalid_grant`)))
+	require.Equal(t, "http_400", errorCode(retrieveError("text/html", `<html></html>`)))
+	require.Equal(t, "timeout", errorCode(errTokenRequestTimeout))
+	require.Equal(t, "circuit_open", errorCode(errCircuitOpen))
+	require.Equal(t, "canceled", errorCode(context.Canceled))
+}
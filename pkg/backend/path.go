@@ -9,7 +9,13 @@ func pathsSpecial() *logical.Paths {
 	return &logical.Paths{
 		SealWrapStorage: []string{
 			configPath,
+			saltPath,
 			credsPathPrefix,
+			exchangePathPrefix,
+			jwtBearerPathPrefix,
+			dpopKeysPathPrefix,
+			proxyPathPrefix,
+			eventsPath,
 		},
 	}
 }
@@ -18,5 +24,11 @@ func paths(b *backend) []*framework.Path {
 	return []*framework.Path{
 		pathConfig(b),
 		pathCreds(b),
+		pathDPoPProof(b),
+		pathExchange(b),
+		pathProxy(b),
+		pathJWTBearer(b),
+		pathEvents(b),
+		pathStatus(b),
 	}
 }
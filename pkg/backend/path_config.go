@@ -2,7 +2,9 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -13,6 +15,35 @@ type config struct {
 	ClientSecret string   `json:"client_secret"`
 	TokenURL     string   `json:"token_url"`
 	Scopes       []string `json:"scopes"`
+
+	AllowedScopes      []string `json:"allowed_scopes"`
+	AllowScopeOverride bool     `json:"allow_scope_override"`
+
+	MaxRetries              int           `json:"max_retries"`
+	RetryMinBackoff         time.Duration `json:"retry_min_backoff"`
+	RetryMaxBackoff         time.Duration `json:"retry_max_backoff"`
+	CircuitBreakerThreshold int           `json:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown  time.Duration `json:"circuit_breaker_cooldown"`
+
+	StaleIfError   time.Duration `json:"stale_if_error"`
+	RequestTimeout time.Duration `json:"request_timeout"`
+	DefaultTTL     time.Duration `json:"default_ttl"`
+	MaxTTL         time.Duration `json:"max_ttl"`
+	ClockSkew      time.Duration `json:"clock_skew"`
+
+	RateLimit        int           `json:"rate_limit"`
+	RateLimitBurst   int           `json:"rate_limit_burst"`
+	RateLimitMaxWait time.Duration `json:"rate_limit_max_wait"`
+
+	EventsBufferSize int `json:"events_buffer_size"`
+
+	NameBinding string `json:"name_binding"`
+
+	DPoP bool `json:"dpop"`
+
+	ProxyAllowedURLs []string `json:"proxy_allowed_urls"`
+
+	JWTBearerAudiences []string `json:"jwt_bearer_audiences"`
 }
 
 func getConfig(ctx context.Context, storage logical.Storage) (*config, error) {
@@ -44,6 +75,35 @@ func (b *backend) configReadOperation(ctx context.Context, req *logical.Request,
 			"client_id": c.ClientID,
 			"token_url": c.TokenURL,
 			"scopes":    c.Scopes,
+
+			"allowed_scopes":       c.AllowedScopes,
+			"allow_scope_override": c.AllowScopeOverride,
+
+			"max_retries":               c.MaxRetries,
+			"retry_min_backoff":         int64(c.RetryMinBackoff.Seconds()),
+			"retry_max_backoff":         int64(c.RetryMaxBackoff.Seconds()),
+			"circuit_breaker_threshold": c.CircuitBreakerThreshold,
+			"circuit_breaker_cooldown":  int64(c.CircuitBreakerCooldown.Seconds()),
+
+			"stale_if_error":  int64(c.StaleIfError.Seconds()),
+			"request_timeout": int64(c.RequestTimeout.Seconds()),
+			"default_ttl":     int64(c.DefaultTTL.Seconds()),
+			"max_ttl":         int64(c.MaxTTL.Seconds()),
+			"clock_skew":      int64(c.ClockSkew.Seconds()),
+
+			"rate_limit":          c.RateLimit,
+			"rate_limit_burst":    c.RateLimitBurst,
+			"rate_limit_max_wait": int64(c.RateLimitMaxWait.Seconds()),
+
+			"events_buffer_size": c.EventsBufferSize,
+
+			"name_binding": c.NameBinding,
+
+			"dpop": c.DPoP,
+
+			"proxy_allowed_urls": c.ProxyAllowedURLs,
+
+			"jwt_bearer_audiences": c.JWTBearerAudiences,
 		},
 	}
 	return resp, nil
@@ -69,11 +129,95 @@ func (b *backend) configUpdateOperation(ctx context.Context, req *logical.Reques
 		ClientID:     clientID.(string),
 		ClientSecret: clientSecret.(string),
 		TokenURL:     tokenURL.(string),
+
+		AllowedScopes:      data.Get("allowed_scopes").([]string),
+		AllowScopeOverride: data.Get("allow_scope_override").(bool),
+
+		MaxRetries:              data.Get("max_retries").(int),
+		RetryMinBackoff:         time.Duration(data.Get("retry_min_backoff").(int)) * time.Second,
+		RetryMaxBackoff:         time.Duration(data.Get("retry_max_backoff").(int)) * time.Second,
+		CircuitBreakerThreshold: data.Get("circuit_breaker_threshold").(int),
+		CircuitBreakerCooldown:  time.Duration(data.Get("circuit_breaker_cooldown").(int)) * time.Second,
+
+		StaleIfError:   time.Duration(data.Get("stale_if_error").(int)) * time.Second,
+		RequestTimeout: time.Duration(data.Get("request_timeout").(int)) * time.Second,
+		DefaultTTL:     time.Duration(data.Get("default_ttl").(int)) * time.Second,
+		MaxTTL:         time.Duration(data.Get("max_ttl").(int)) * time.Second,
+		ClockSkew:      time.Duration(data.Get("clock_skew").(int)) * time.Second,
+
+		RateLimit:        data.Get("rate_limit").(int),
+		RateLimitBurst:   data.Get("rate_limit_burst").(int),
+		RateLimitMaxWait: time.Duration(data.Get("rate_limit_max_wait").(int)) * time.Second,
+
+		EventsBufferSize: data.Get("events_buffer_size").(int),
+
+		NameBinding: data.Get("name_binding").(string),
+
+		DPoP: data.Get("dpop").(bool),
+
+		ProxyAllowedURLs: data.Get("proxy_allowed_urls").([]string),
+
+		JWTBearerAudiences: data.Get("jwt_bearer_audiences").([]string),
+	}
+
+	if scopes, ok := data.GetOk("scopes"); ok {
+		for _, scope := range scopes.([]string) {
+			if err := validateScopeTemplate(scope); err != nil {
+				return scopesErrorResponse(err)
+			}
+		}
+
+		set, err := newScopeSet(scopes.([]string))
+		if err != nil {
+			return scopesErrorResponse(err)
+		}
+		c.Scopes = set
+	}
+
+	if c.MaxRetries < 0 {
+		return logical.ErrorResponse("Max retries must not be negative"), nil
+	}
+
+	if c.RetryMinBackoff < 0 || c.RetryMaxBackoff < c.RetryMinBackoff {
+		return logical.ErrorResponse("Invalid retry backoff"), nil
+	}
+
+	if c.CircuitBreakerThreshold < 0 || c.CircuitBreakerCooldown < 0 {
+		return logical.ErrorResponse("Invalid circuit breaker settings"), nil
+	}
+
+	if c.StaleIfError < 0 || c.StaleIfError > maxStaleIfError {
+		return logical.ErrorResponse(fmt.Sprintf("Stale if error must be between 0 and %s", maxStaleIfError)), nil
+	}
+
+	if c.RequestTimeout < 0 {
+		return logical.ErrorResponse("Request timeout must not be negative"), nil
 	}
 
-	scopes, ok := data.GetOk("scopes")
-	if ok {
-		c.Scopes = scopes.([]string)
+	if c.DefaultTTL < 0 || (c.DefaultTTL > 0 && c.DefaultTTL < minTTL) {
+		return logical.ErrorResponse(fmt.Sprintf("Default TTL must be zero or at least %s", minTTL)), nil
+	}
+
+	if c.MaxTTL < 0 || (c.MaxTTL > 0 && c.MaxTTL < minTTL) {
+		return logical.ErrorResponse(fmt.Sprintf("Max TTL must be zero or at least %s", minTTL)), nil
+	}
+
+	if c.ClockSkew < 0 {
+		return logical.ErrorResponse("Clock skew must not be negative"), nil
+	}
+
+	if c.RateLimit < 0 || c.RateLimitBurst < 0 || c.RateLimitMaxWait < 0 {
+		return logical.ErrorResponse("Invalid rate limit settings"), nil
+	}
+
+	if c.EventsBufferSize < 0 || c.EventsBufferSize > maxEventsBufferSize {
+		return logical.ErrorResponse(fmt.Sprintf("Events buffer size must be between 0 and %d", maxEventsBufferSize)), nil
+	}
+
+	switch c.NameBinding {
+	case nameBindingNone, nameBindingEntityID, nameBindingEntityName:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported name binding %q", c.NameBinding)), nil
 	}
 
 	entry, err := logical.StorageEntryJSON(configPath, c)
@@ -85,6 +229,8 @@ func (b *backend) configUpdateOperation(ctx context.Context, req *logical.Reques
 		return nil, err
 	}
 
+	b.breaker.reset()
+
 	return nil, nil
 }
 
@@ -93,11 +239,26 @@ func (b *backend) configDeleteOperation(ctx context.Context, req *logical.Reques
 		return nil, err
 	}
 
+	b.breaker.reset()
+
 	return nil, nil
 }
 
 const (
 	configPath = "config"
+
+	nameBindingNone       = ""
+	nameBindingEntityID   = "entity_id"
+	nameBindingEntityName = "entity_name"
+
+	// maxStaleIfError bounds how long past its expiry a token may still be
+	// handed out during a provider outage.
+	maxStaleIfError = time.Hour
+
+	// minTTL bounds how short token lifetimes may be configured. Tokens are
+	// treated as expired shortly before their expiry, so shorter lifetimes
+	// would leave no time to use them.
+	minTTL = time.Minute
 )
 
 var configFields = map[string]*framework.FieldSchema{
@@ -117,6 +278,101 @@ var configFields = map[string]*framework.FieldSchema{
 		Type:        framework.TypeCommaStringSlice,
 		Description: "Comma separated list of default scopes for the token.",
 	},
+	"allowed_scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of scopes that may be requested to override default scopes. A leading or trailing * matches any prefix or suffix. Empty allows any scope.",
+	},
+	"allow_scope_override": {
+		Type:        framework.TypeBool,
+		Description: "Specifies whether default scopes may be overridden when requesting a token.",
+		Default:     true,
+	},
+	"max_retries": {
+		Type:        framework.TypeInt,
+		Description: "Specifies how many times a failed token request is retried on network errors and 5xx or 429 responses.",
+		Default:     0,
+	},
+	"retry_min_backoff": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies the initial delay between token request retries.",
+		Default:     1,
+	},
+	"retry_max_backoff": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies the maximum delay between token request retries.",
+		Default:     30,
+	},
+	"circuit_breaker_threshold": {
+		Type:        framework.TypeInt,
+		Description: "Specifies the number of consecutive failed token requests after which the circuit breaker opens. Zero disables the circuit breaker.",
+		Default:     0,
+	},
+	"circuit_breaker_cooldown": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies how long the circuit breaker stays open before a token request is attempted again.",
+		Default:     30,
+	},
+	"stale_if_error": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies how long after its expiry a cached token may still be returned when a new token cannot be retrieved. Zero disables stale tokens.",
+		Default:     0,
+	},
+	"request_timeout": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies how long a single token request may take. Zero disables the timeout.",
+		Default:     30,
+	},
+	"default_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies the lifetime of tokens the provider issues without an expiry. Zero treats such tokens as never expiring.",
+		Default:     0,
+	},
+	"max_ttl": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies the maximum lifetime of a token after it is issued. Tokens the provider issues for longer are refreshed and reported as expiring earlier. Zero uses the lifetime set by the provider.",
+		Default:     0,
+	},
+	"clock_skew": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies how much earlier than reported by the provider tokens are treated as expired, to tolerate clock differences and delays.",
+		Default:     0,
+	},
+	"rate_limit": {
+		Type:        framework.TypeInt,
+		Description: "Specifies the maximum number of token requests sent to the token endpoint per minute. Zero disables rate limiting.",
+		Default:     0,
+	},
+	"rate_limit_burst": {
+		Type:        framework.TypeInt,
+		Description: "Specifies how many token requests may be sent at once before the rate limit applies.",
+		Default:     1,
+	},
+	"rate_limit_max_wait": {
+		Type:        framework.TypeDurationSecond,
+		Description: "Specifies how long a token request may wait for the rate limit before it is rejected. Zero rejects throttled requests immediately.",
+		Default:     0,
+	},
+	"events_buffer_size": {
+		Type:        framework.TypeInt,
+		Description: "Specifies how many recent token retrievals that didn't return a cached token are kept for the events endpoint. Zero disables the events buffer.",
+		Default:     0,
+	},
+	"name_binding": {
+		Type:        framework.TypeString,
+		Description: `Specifies whether credential names must match the identity of the caller, either "entity_id" or "entity_name". Empty allows any name.`,
+	},
+	"dpop": {
+		Type:        framework.TypeBool,
+		Description: "Specifies whether tokens are bound to a DPoP key pair generated for each credential.",
+	},
+	"proxy_allowed_urls": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of URLs the proxy endpoint may send requests to. A leading or trailing * matches any prefix or suffix.",
+	},
+	"jwt_bearer_audiences": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of audiences of which identity tokens presented to the jwt-bearer endpoint must be issued for one. Empty requires the token URL.",
+	},
 }
 
 const configHelpSynopsis = `
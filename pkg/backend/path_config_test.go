@@ -123,3 +123,39 @@ func TestRequireParameters(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualError(t, resp.Error(), "Missing token URL")
 }
+
+func TestConfigScopes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	storage := &logical.InmemStorage{}
+	backend, err := Factory(ctx, &logical.BackendConfig{})
+	require.NoError(t, err)
+
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"scopes":        "b, a ,a",
+		},
+	}
+
+	// Scopes are stored as a canonical set
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	c, err := getConfig(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, c.Scopes)
+
+	// Invalid scopes are rejected
+	write.Data["scopes"] = `a,"b"`
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Error(t, resp.Error())
+}
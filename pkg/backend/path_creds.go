@@ -2,12 +2,18 @@ package backend
 
 import (
 	"context"
-	"crypto/sha1"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/salt"
 	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
@@ -18,6 +24,17 @@ const (
 	credsPathPrefix = credsPath + "/"
 )
 
+const (
+	tokenFormatDefault             = ""
+	tokenFormatAuthorizationHeader = "authorization_header"
+	tokenFormatJSON                = "json"
+	tokenFormatNetrc               = "netrc"
+
+	// netrcLogin is the login of netrc lines, which most services ignore for
+	// token authentication.
+	netrcLogin = "oauth2"
+)
+
 func getTokenFromStorage(ctx context.Context, storage logical.Storage, key string) (*oauth2.Token, error) {
 	entry, err := storage.Get(ctx, key)
 	if err != nil {
@@ -34,76 +51,250 @@ func getTokenFromStorage(ctx context.Context, storage logical.Storage, key strin
 	return tok, nil
 }
 
-func (b *backend) getToken(ctx context.Context, storage logical.Storage, c *config, key string, scopes []string) (*oauth2.Token, error) {
-	tok, err := getTokenFromStorage(ctx, storage, key)
-	if err != nil {
-		return nil, err
+// tokenRequest describes a token to retrieve and the storage key it is cached
+// under.
+type tokenRequest struct {
+	name   string
+	key    string
+	scopes scopeSet
+	force  bool
+
+	// dpopKey is the storage key of the DPoP key pair the token is bound to
+	// if DPoP is enabled.
+	dpopKey string
+
+	// params are sent to the token endpoint in addition to the client
+	// credentials grant parameters and may override the grant type.
+	params url.Values
+
+	// unique requests a new token that is neither cached nor shared with
+	// other requests. It is identified by issuanceID in events.
+	unique     bool
+	issuanceID string
+}
+
+// getToken returns the token stored under the request key, requesting a new
+// one from the token endpoint if it is missing, expired or a refresh is
+// forced. Stored refresh tokens are used in place of a new grant. If the
+// token endpoint cannot be reached and the stored token is still within the
+// configured stale_if_error window, the stored token is returned and reported
+// as stale. Unique tokens are always requested and never stored.
+func (b *backend) getToken(ctx context.Context, req *logical.Request, c *config, tr *tokenRequest) (tok *oauth2.Token, stale bool, err error) {
+	storage := req.Storage
+	labels := metricLabels(req.MountPoint, c)
+
+	ev := &tokenEvent{
+		Name:            tr.name,
+		RequestedScopes: tr.scopes,
+		Cache:           cacheHit,
+		IssuanceID:      tr.issuanceID,
+	}
+	defer func() {
+		b.recordEvent(ctx, storage, c, ev, tok, err)
+	}()
+
+	config := &clientcredentials.Config{
+		ClientID:       c.ClientID,
+		ClientSecret:   c.ClientSecret,
+		TokenURL:       c.TokenURL,
+		Scopes:         tr.scopes,
+		EndpointParams: tr.params,
 	}
 
-	// Generate new token
-	if tok == nil || !tok.Valid() {
-		config := &clientcredentials.Config{
-			ClientID:     c.ClientID,
-			ClientSecret: c.ClientSecret,
-			TokenURL:     c.TokenURL,
-			Scopes:       c.Scopes,
+	if tr.unique {
+		b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "cache"}, 1, withLabel(labels, "result", cacheUnique))
+		ev.Cache = cacheUnique
+
+		fctx, err := b.fetchContext(ctx, storage, c, tr)
+		if err != nil {
+			return nil, false, err
 		}
 
-		// Override default scopes if provided
-		if scopes != nil {
-			config.Scopes = scopes
+		tok, err = b.fetchToken(fctx, c, config.Token, b.clock.Now(), labels)
+		return tok, false, err
+	}
+
+	tok, err = getTokenFromStorage(ctx, storage, tr.key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Generate new token
+	if tr.force || tok == nil || !tokenValid(c, tok, b.clock.Now()) {
+		start := time.Now()
+		queued := b.clock.Now()
+		defer b.lockToken(tr.key)()
+		b.metrics.MeasureSinceWithLabels([]string{"oauth", "token", "lock_wait"}, start, labels)
+
+		// Check if the token is not already in storage. A forced refresh is
+		// satisfied by a token stored by another request while we were
+		// waiting for the lock.
+		stored, err := getTokenFromStorage(ctx, storage, tr.key)
+		if err != nil {
+			return nil, false, err
+		} else if stored != nil && tokenValid(c, stored, b.clock.Now()) && (!tr.force || tok == nil || stored.AccessToken != tok.AccessToken) {
+			b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "cache"}, 1, withLabel(labels, "result", cacheHit))
+			return stored, false, nil
 		}
 
-		b.credMut.Lock()
-		defer b.credMut.Unlock()
+		b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "cache"}, 1, withLabel(labels, "result", cacheMiss))
+		ev.Cache = cacheMiss
 
-		// Check if the token is not already in storage
-		tok, err = getTokenFromStorage(ctx, storage, key)
-		if err != nil && tok != nil && tok.Valid() {
-			return tok, nil
+		fctx, err := b.fetchContext(ctx, storage, c, tr)
+		if err != nil {
+			return nil, false, err
 		}
 
-		tok, err = config.Token(ctx)
-		if rErr, ok := err.(*oauth2.RetrieveError); ok {
-			b.logger.Error("Invalid client credentials", "error", rErr)
-			return nil, errInvalidCredentials
-		} else if err != nil {
-			return nil, err
+		// Prefer the refresh token if the provider issued one, falling back
+		// to a new grant if it is rejected.
+		if stored != nil && stored.RefreshToken != "" {
+			tok, err = b.fetchToken(fctx, c, refreshTokenFunc(c, stored.RefreshToken), queued, labels)
+			if errors.Is(err, errRefreshTokenRejected) {
+				b.logger.Debug("Refresh token rejected, requesting new token", "name", tr.name, "error", err)
+				tok, err = b.fetchToken(fctx, c, config.Token, queued, labels)
+			}
+		} else {
+			tok, err = b.fetchToken(fctx, c, config.Token, queued, labels)
+		}
+		if err != nil {
+			if !tr.force && staleTokenUsable(c, stored, err, b.clock.Now()) {
+				b.logger.Warn("Returning stale token", "expires", stored.Expiry, "error", err)
+				ev.Cache = cacheStale
+				return stored, true, nil
+			}
+			return nil, false, err
 		}
 
-		entry, err := logical.StorageEntryJSON(key, tok)
+		entry, err := logical.StorageEntryJSON(tr.key, tok)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		if err := storage.Put(ctx, entry); err != nil {
-			return nil, err
+			return nil, false, err
 		}
+	} else {
+		b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "cache"}, 1, withLabel(labels, "result", cacheHit))
 	}
 
-	return tok, nil
+	return tok, false, nil
+}
+
+// fetchContext returns the context token requests for tr are sent with. With
+// DPoP enabled, every token request carries a proof signed by the key pair of
+// the credential.
+func (b *backend) fetchContext(ctx context.Context, storage logical.Storage, c *config, tr *tokenRequest) (context.Context, error) {
+	client := b.httpClient()
+	if !c.DPoP || tr.dpopKey == "" {
+		return clientContext(ctx, client), nil
+	}
+
+	pk, err := b.getDPoPKey(ctx, storage, tr.dpopKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientContext(ctx, dpopClient(client, pk, "", b.clock)), nil
+}
+
+// staleTokenUsable reports whether tok may be returned at the given time in
+// place of a fresh token after the token endpoint failed with err.
+func staleTokenUsable(c *config, tok *oauth2.Token, err error, now time.Time) bool {
+	if c.StaleIfError <= 0 || tok == nil || tok.AccessToken == "" || tok.Expiry.IsZero() {
+		return false
+	}
+
+	// The provider rejected our credentials, so it is reachable and the
+	// failure is not an outage.
+	if errors.Is(err, errInvalidCredentials) {
+		return false
+	}
+
+	return now.Before(tok.Expiry.Add(c.StaleIfError))
+}
+
+// boundName returns the name that keys of the credential name requested by the
+// caller are derived from. With a name binding configured, callers may only
+// use a name matching their own identity and keys are derived from their
+// entity ID.
+func (b *backend) boundName(req *logical.Request, c *config, name string) (string, error) {
+	if c.NameBinding == nameBindingNone {
+		return name, nil
+	}
+
+	if req.EntityID == "" {
+		return "", logical.ErrPermissionDenied
+	}
+
+	switch c.NameBinding {
+	case nameBindingEntityID:
+		if name != req.EntityID {
+			return "", logical.ErrPermissionDenied
+		}
+	case nameBindingEntityName:
+		entity, err := b.system().EntityInfo(req.EntityID)
+		if err != nil {
+			return "", err
+		} else if entity == nil || entity.Name != name {
+			return "", logical.ErrPermissionDenied
+		}
+	}
+
+	return req.EntityID, nil
 }
 
 // credKey hashes the name and splits the first few bytes into separate buckets
 // for performance reasons.
-func credKey(name string) string {
-	hash := sha1.Sum([]byte(name))
-	first, second, rest := hash[:2], hash[2:4], hash[4:]
-	return credsPathPrefix + fmt.Sprintf("%x/%x/%x", first, second, rest)
+func credKey(s *salt.Salt, name string) string {
+	return hashedKey(s, credsPathPrefix, name)
+}
+
+// hashedKey derives a key below prefix from an HMAC of the name keyed with the
+// salt of the mount, so that names can't be confirmed from storage.
+func hashedKey(s *salt.Salt, prefix, name string) string {
+	hash := s.GetHMAC(name)
+	return prefix + hash[:4] + "/" + hash[4:8] + "/" + hash[8:]
 }
 
 // credKeyWithScopes adds scopes to the key to differentiate between
-// tokens generated with different scopes.
-func credKeyWithScopes(key string, scopes []string) string {
-	// We assign a default single byte hashScopes if no scopes are provided.
-	// This will never conflict with 20 byte sha1 sum from credKey.
-	hashScopes := [20]byte{65}
-	sort.Strings(scopes)
-	if scopes != nil {
-		hashScopes = sha1.Sum([]byte(strings.Join(scopes, ",")))
+// tokens generated with different scopes and DPoP modes.
+func credKeyWithScopes(s *salt.Salt, key string, scopes scopeSet, dpop bool) string {
+	return key + "/" + s.GetHMAC(dpopKeyParts(encodeStrings(scopes...), dpop))
+}
+
+// dpopKeyParts marks the encoded parts of a token key if the token is bound
+// to a DPoP key pair, so that toggling DPoP never returns a token of the other
+// type. Keys of bearer tokens are unchanged. The mark can't be confused with
+// encoded parts, which start with a digit.
+func dpopKeyParts(parts string, dpop bool) string {
+	if !dpop {
+		return parts
 	}
 
-	return key + fmt.Sprintf("/%x", hashScopes)
+	return "dpop:" + parts
+}
+
+// encodeStrings encodes items unambiguously, regardless of the characters
+// they contain.
+func encodeStrings(items ...string) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.Itoa(len(items)))
+	for _, item := range items {
+		fmt.Fprintf(&sb, ";%d:%s", len(item), item)
+	}
+	return sb.String()
+}
+
+// encodeSet encodes items like encodeStrings, ignoring their order. A nil set
+// is encoded differently from an empty one.
+func encodeSet(items []string) string {
+	if items == nil {
+		return ""
+	}
+
+	sorted := append([]string(nil), items...)
+	sort.Strings(sorted)
+	return encodeStrings(sorted...)
 }
 
 func (b *backend) credsReadOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -114,52 +305,223 @@ func (b *backend) credsReadOperation(ctx context.Context, req *logical.Request,
 		return logical.ErrorResponse("Not configured"), nil
 	}
 
-	scopes := c.Scopes
-	if d, ok := data.GetOk("scopes"); ok {
-		scopes = d.([]string)
+	defer b.metrics.MeasureSinceWithLabels([]string{"oauth", "creds", "read"}, time.Now(), metricLabels(req.MountPoint, c))
+
+	format := data.Get("format").(string)
+	switch format {
+	case tokenFormatDefault, tokenFormatAuthorizationHeader, tokenFormatJSON, tokenFormatNetrc:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported format %q", format)), nil
 	}
 
-	key := credKeyWithScopes(credKey(data.Get("name").(string)), scopes)
-	tok, err := b.getToken(ctx, req.Storage, c, key, scopes)
+	scopes, err := b.requestedScopes(req, c, data)
+	if err != nil {
+		return scopesErrorResponse(err)
+	}
 
-	if err == errInvalidCredentials {
-		return logical.ErrorResponse("Invalid client credentials"), nil
-	} else if err != nil {
+	name := data.Get("name").(string)
+	bound, err := b.boundName(req, c, name)
+	if err != nil {
 		return nil, err
-	} else if tok == nil {
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &tokenRequest{
+		name:    name,
+		key:     credKeyWithScopes(s, credKey(s, bound), scopes, c.DPoP),
+		scopes:  scopes,
+		force:   data.Get("force_refresh").(bool),
+		dpopKey: dpopKeyPath(s, bound),
+		unique:  data.Get("unique").(bool),
+	}
+
+	if tr.unique {
+		if tr.issuanceID, err = uuid.GenerateUUID(); err != nil {
+			return nil, err
+		}
+	}
+
+	tok, stale, err := b.getToken(ctx, req, c, tr)
+	if err != nil {
+		return tokenErrorResponse(err)
+	}
+
+	now := b.clock.Now()
+	resp, err := tokenResponse(tok, stale, now)
+	if err != nil || resp == nil || resp.IsError() {
+		return resp, err
+	}
+
+	if format != tokenFormatDefault {
+		resp.Data = formatToken(tok, format, data.Get("netrc_machine").(string), now)
+		if stale {
+			resp.Data["stale"] = true
+		}
+	}
+
+	if tr.unique {
+		resp.Data["issuance_id"] = tr.issuanceID
+	}
+
+	return resp, nil
+}
+
+// formatToken returns the response data for tok at the given time in the given
+// format. Refresh tokens are never included.
+func formatToken(tok *oauth2.Token, format, machine string, now time.Time) map[string]interface{} {
+	switch format {
+	case tokenFormatAuthorizationHeader:
+		return map[string]interface{}{
+			"authorization_header": tok.Type() + " " + tok.AccessToken,
+			"expires":              tok.Expiry,
+			"ttl":                  tokenTTL(tok, now),
+		}
+	case tokenFormatJSON:
+		// Token response as defined in RFC 6749 section 5.1
+		rd := map[string]interface{}{
+			"access_token": tok.AccessToken,
+			"token_type":   tok.Type(),
+		}
+		if !tok.Expiry.IsZero() {
+			rd["expires_in"] = tokenTTL(tok, now)
+		}
+		return rd
+	case tokenFormatNetrc:
+		entry := "default"
+		if machine != "" {
+			entry = "machine " + machine
+		}
+		return map[string]interface{}{
+			"netrc":   fmt.Sprintf("%s login %s password %s", entry, netrcLogin, tok.AccessToken),
+			"expires": tok.Expiry,
+			"ttl":     tokenTTL(tok, now),
+		}
+	default:
+		return nil
+	}
+}
+
+// tokenTTL returns the number of seconds from the given time until tok
+// expires. Tokens without an expiry and expired tokens have a TTL of zero.
+func tokenTTL(tok *oauth2.Token, now time.Time) int64 {
+	if tok.Expiry.IsZero() {
+		return 0
+	}
+
+	if ttl := tok.Expiry.Sub(now); ttl > 0 {
+		return int64(ttl.Seconds())
+	}
+
+	return 0
+}
+
+// tokenResponse returns the token retrieved by getToken to the client at the
+// given time.
+func tokenResponse(tok *oauth2.Token, stale bool, now time.Time) (*logical.Response, error) {
+	if tok == nil {
 		return nil, nil
-	} else if !tok.Valid() {
+	} else if !stale && !tokenValidAt(tok, now) {
 		return logical.ErrorResponse("Token expired"), nil
 	}
 
 	rd := map[string]interface{}{
 		"access_token": tok.AccessToken,
 		"expires":      tok.Expiry,
+		"ttl":          tokenTTL(tok, now),
 	}
 
 	resp := &logical.Response{
 		Data: rd,
 	}
+
+	if stale {
+		rd["stale"] = true
+		resp.AddWarning(fmt.Sprintf("Token endpoint unavailable, returning a stale token that expires at %s", tok.Expiry.Format(time.RFC3339)))
+	}
+
 	return resp, nil
 }
 
+// tokenErrorResponse translates an error from getToken to the response
+// returned to the client.
+func tokenErrorResponse(err error) (*logical.Response, error) {
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		return logical.ErrorResponse("Invalid client credentials"), nil
+	case errors.Is(err, errTokenEndpointUnavailable), errors.Is(err, errCircuitOpen):
+		return nil, logical.CodedError(http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, errTokenRequestTimeout):
+		return nil, logical.CodedError(http.StatusGatewayTimeout, err.Error())
+	case errors.Is(err, errRateLimited):
+		return nil, logical.CodedError(http.StatusTooManyRequests, err.Error())
+	default:
+		return nil, err
+	}
+}
+
 func (b *backend) credsDeleteOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	b.credMut.Lock()
-	defer b.credMut.Unlock()
+	name, err := b.deleteName(ctx, req, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
 
-	key := credKey(data.Get("name").(string))
-	scopes, err := req.Storage.List(ctx, key+"/")
+	s, err := b.getSalt(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := b.deleteTokens(ctx, req.Storage, credKey(s, name)); err != nil {
+		return nil, err
+	}
+
+	if err := b.deleteTokens(ctx, req.Storage, proxyKey(s, name)); err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, dpopKeyPath(s, name)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// deleteName returns the name that keys of a credential being deleted are
+// derived from, applying the configured name binding.
+func (b *backend) deleteName(ctx context.Context, req *logical.Request, name string) (string, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return "", err
+	} else if c == nil {
+		return name, nil
+	}
+
+	return b.boundName(req, c, name)
+}
+
+// deleteTokens removes all tokens stored below key.
+func (b *backend) deleteTokens(ctx context.Context, storage logical.Storage, key string) error {
+	scopes, err := storage.List(ctx, key+"/")
+	if err != nil {
+		return err
+	}
+
 	for _, scope := range scopes {
-		if err := req.Storage.Delete(ctx, key+"/"+scope); err != nil {
-			return nil, err
+		if err := b.deleteToken(ctx, storage, key+"/"+scope); err != nil {
+			return err
 		}
 	}
 
-	return nil, nil
+	return nil
+}
+
+func (b *backend) deleteToken(ctx context.Context, storage logical.Storage, key string) error {
+	defer b.lockToken(key)()
+
+	return storage.Delete(ctx, key)
 }
 
 var credsFields = map[string]*framework.FieldSchema{
@@ -168,8 +530,24 @@ var credsFields = map[string]*framework.FieldSchema{
 		Description: "Specifies the name of the credential.",
 	},
 	"scopes": {
-		Type:    framework.TypeCommaStringSlice,
-		Default: "Comma separated list of scopes for the token to override default scopes from config.",
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of scopes for the token to override default scopes from config.",
+	},
+	"force_refresh": {
+		Type:        framework.TypeBool,
+		Description: "Specifies whether to retrieve a new token even if the stored token is still valid.",
+	},
+	"format": {
+		Type:        framework.TypeString,
+		Description: `Specifies the format of the token, either "authorization_header", "json" or "netrc". Empty returns the access token and its expiry.`,
+	},
+	"unique": {
+		Type:        framework.TypeBool,
+		Description: "Specifies whether to retrieve a new token that is neither cached nor returned to other requests.",
+	},
+	"netrc_machine": {
+		Type:        framework.TypeString,
+		Description: "Specifies the machine of the netrc line. Empty returns a default entry.",
 	},
 }
 
@@ -9,13 +9,14 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/sdk/helper/salt"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/oauth2"
 )
 
 type MockRoundTripper struct {
@@ -28,6 +29,14 @@ func (mrt *MockRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 	return w.Result(), nil
 }
 
+// staticTransport returns a transport factory for backend options that always
+// returns rt.
+func staticTransport(rt http.RoundTripper) func() http.RoundTripper {
+	return func() http.RoundTripper {
+		return rt
+	}
+}
+
 func TestTokenRead(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -55,12 +64,7 @@ func TestTokenRead(t *testing.T) {
 				assert.Equal(t, "client_credentials", data.Get("grant_type"))
 				assert.True(t, strings.HasPrefix(data.Get("scope"), "a b c"))
 
-				expiresIn := 5
-				if i > 1 {
-					expiresIn = 3600
-				}
-
-				w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=%d`, i, expiresIn)))
+				w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, i)))
 				i++
 			default:
 				assert.Fail(t, "unexpected `grant_type` value: %q", data.Get("grant_type"))
@@ -69,11 +73,14 @@ func TestTokenRead(t *testing.T) {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	})
-	c := &http.Client{Transport: &MockRoundTripper{Handler: h}}
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, c)
+
+	clk := &fakeClock{now: time.Now()}
 
 	storage := &logical.InmemStorage{}
-	backend, err := Factory(ctx, &logical.BackendConfig{})
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{
+		Clock:     clk,
+		Transport: staticTransport(&MockRoundTripper{Handler: h}),
+	})
 	require.NoError(t, err)
 
 	// Write new config
@@ -100,13 +107,17 @@ func TestTokenRead(t *testing.T) {
 		Storage:   storage,
 	}
 
-	// Get new token - shall be expired
+	// Get new token
 	resp, err = backend.HandleRequest(ctx, read)
 	require.NoError(t, err)
-	require.NotNil(t, resp)
-	require.EqualError(t, resp.Error(), "Token expired")
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.Equal(t, int64(3600), resp.Data["ttl"])
 
-	// Token should not be expired
+	// Token expires an hour later
+	clk.Add(time.Hour)
+
+	// Token should be refreshed
 	resp, err = backend.HandleRequest(ctx, read)
 	require.NoError(t, err)
 	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
@@ -224,11 +235,9 @@ func TestReadInvalidCredentials(t *testing.T) {
 	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	})
-	c := &http.Client{Transport: &MockRoundTripper{Handler: h}}
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, c)
 
 	storage := &logical.InmemStorage{}
-	backend, err := Factory(ctx, &logical.BackendConfig{})
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
 	require.NoError(t, err)
 
 	// Write new config
@@ -259,3 +268,970 @@ func TestReadInvalidCredentials(t *testing.T) {
 	require.NotNil(t, resp)
 	require.EqualError(t, resp.Error(), "Invalid client credentials")
 }
+
+func TestTokenReadStaleIfError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status := http.StatusOK
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		// Token is already within the expiry delta and will be refreshed
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=5`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":      "foo",
+			"client_secret":  "bar",
+			"token_url":      "http://localhost/token",
+			"stale_if_error": 60,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Token expired")
+
+	// Provider is down, stale token is returned with a warning
+	status = http.StatusServiceUnavailable
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+	require.Equal(t, true, resp.Data["stale"])
+	require.Len(t, resp.Warnings, 1)
+
+	// Formatted stale tokens are flagged as well
+	for _, format := range []string{tokenFormatAuthorizationHeader, tokenFormatJSON, tokenFormatNetrc} {
+		read.Data = map[string]interface{}{"format": format}
+		resp, err = backend.HandleRequest(ctx, read)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+		require.Equal(t, true, resp.Data["stale"], format)
+		require.Len(t, resp.Warnings, 1)
+	}
+	read.Data = nil
+
+	// Rejected credentials never fall back to a stale token
+	status = http.StatusUnauthorized
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid client credentials")
+
+	// Stale tokens are disabled by default
+	delete(write.Data, "stale_if_error")
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	status = http.StatusServiceUnavailable
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errTokenEndpointUnavailable.Error())
+}
+
+func TestTokenReadTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Token endpoint never responds
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Consume the body so that the server notices the client going away
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	storage := &logical.InmemStorage{}
+	backend, err := Factory(ctx, &logical.BackendConfig{})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":       "foo",
+			"client_secret":   "bar",
+			"token_url":       srv.URL + "/token",
+			"request_timeout": 1,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	start := time.Now()
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errTokenRequestTimeout.Error())
+	require.Equal(t, http.StatusGatewayTimeout, err.(logical.HTTPCodedError).Code())
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestTokenReadForceRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mut sync.Mutex
+	i := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		i++
+		n := i
+		mut.Unlock()
+
+		// Slow token endpoint lets concurrent refreshes queue up
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, n)))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Valid token is replaced
+	read.Data = map[string]interface{}{
+		"force_refresh": true,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+
+	// New token is stored
+	read.Data = nil
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+
+	// Concurrent forced refreshes share a single new token
+	var wg sync.WaitGroup
+	tokens := make([]interface{}, 3)
+	for j := range tokens {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+
+			resp, err := backend.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      credsPath + "/user",
+				Storage:   storage,
+				Data: map[string]interface{}{
+					"force_refresh": true,
+				},
+			})
+			if assert.NoError(t, err) && assert.NotNil(t, resp) {
+				tokens[j] = resp.Data["access_token"]
+			}
+		}(j)
+	}
+	wg.Wait()
+
+	require.Equal(t, []interface{}{"abcd3", "abcd3", "abcd3"}, tokens)
+}
+
+func TestTokenReadNameBinding(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{
+		System: &logical.StaticSystemView{
+			EntityVal: &logical.Entity{ID: "entity1", Name: "team-a"},
+		},
+	}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"name_binding":  "entity_id",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token of the caller's entity
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/entity1",
+		Storage:   storage,
+		EntityID:  "entity1",
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Names of other entities are rejected
+	read.Path = credsPath + "/entity2"
+	_, err = backend.HandleRequest(ctx, read)
+	require.Equal(t, logical.ErrPermissionDenied, err)
+
+	// Requests without an entity are rejected
+	read.Path = credsPath + "/entity1"
+	read.EntityID = ""
+	_, err = backend.HandleRequest(ctx, read)
+	require.Equal(t, logical.ErrPermissionDenied, err)
+
+	// Bind names to entity names instead
+	write.Data["name_binding"] = "entity_name"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Token is keyed by entity ID and shared with the previous binding
+	read.Path = credsPath + "/team-a"
+	read.EntityID = "entity1"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	read.Path = credsPath + "/team-b"
+	_, err = backend.HandleRequest(ctx, read)
+	require.Equal(t, logical.ErrPermissionDenied, err)
+
+	// Deletes are bound as well
+	delete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      credsPath + "/team-b",
+		Storage:   storage,
+		EntityID:  "entity1",
+	}
+
+	_, err = backend.HandleRequest(ctx, delete)
+	require.Equal(t, logical.ErrPermissionDenied, err)
+
+	delete.Path = credsPath + "/team-a"
+	resp, err = backend.HandleRequest(ctx, delete)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, credsPathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// Unknown bindings are rejected
+	write.Data["name_binding"] = "token"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Unsupported name binding "token"`)
+}
+
+func TestTokenReadRefreshToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var grants []string
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		grants = append(grants, data.Get("grant_type"))
+
+		switch data.Get("grant_type") {
+		case "client_credentials":
+			w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600&refresh_token=refresh%d`, i, i)))
+		case "refresh_token":
+			if data.Get("refresh_token") != "refresh1" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+
+			// Refresh token is rotated on the first refresh only
+			refresh := ""
+			if i == 2 {
+				refresh = "&refresh_token=refresh2"
+			}
+			w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600%s`, i, refresh)))
+		default:
+			assert.Fail(t, "unexpected `grant_type` value: %q", data.Get("grant_type"))
+		}
+		i++
+	})
+
+	m, sink := newTestMetrics(t)
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Metrics: m, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"force_refresh": true,
+		},
+	}
+
+	for j := 1; j <= 3; j++ {
+		resp, err = backend.HandleRequest(ctx, read)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+		require.NotContains(t, resp.Data, "refresh_token")
+	}
+
+	// Refresh token of the first grant is used, rotated refresh token is
+	// rejected and replaced by a new grant
+	require.Equal(t, []string{"client_credentials", "refresh_token", "refresh_token", "client_credentials"}, grants)
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+
+	// Rejected refresh tokens are not failures of the token endpoint
+	require.Equal(t, 0, counterValue(sink, "oauth.token.error;mount=;provider=localhost;error=invalid_grant"))
+
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      statusPath,
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.Data["last_failure"])
+	require.Empty(t, resp.Data["last_error"])
+}
+
+func TestTokenReadFormat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"abcd","token_type":"DPoP","refresh_token":"efgh","expires_in":3600}`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+		Data:      map[string]interface{}{},
+	}
+
+	read.Data["format"] = tokenFormatAuthorizationHeader
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "DPoP abcd", resp.Data["authorization_header"])
+	require.NotEmpty(t, resp.Data["expires"])
+
+	read.Data["format"] = tokenFormatJSON
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+	require.Equal(t, "DPoP", resp.Data["token_type"])
+	require.InDelta(t, 3600, resp.Data["expires_in"], 10)
+	require.NotContains(t, resp.Data, "refresh_token")
+
+	read.Data["format"] = tokenFormatNetrc
+	read.Data["netrc_machine"] = "api.example.com"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "machine api.example.com login oauth2 password abcd", resp.Data["netrc"])
+
+	read.Data["format"] = "xml"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Unsupported format "xml"`)
+}
+
+func TestTokenReadUnique(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":          "foo",
+			"client_secret":      "bar",
+			"token_url":          "http://localhost/token",
+			"events_buffer_size": 10,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"unique": true,
+		},
+	}
+
+	// Every unique read issues a new token
+	var ids []string
+	for _, expected := range []string{"abcd1", "abcd2"} {
+		resp, err = backend.HandleRequest(ctx, read)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+		require.Equal(t, expected, resp.Data["access_token"])
+		require.NotEmpty(t, resp.Data["issuance_id"])
+		ids = append(ids, resp.Data["issuance_id"].(string))
+	}
+	require.NotEqual(t, ids[0], ids[1])
+
+	// Unique tokens are not cached
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, credsPathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	delete(read.Data, "unique")
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+	require.NotContains(t, resp.Data, "issuance_id")
+
+	// Issuances are recorded in events
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      eventsPath,
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+
+	events := resp.Data["events"].([]map[string]interface{})
+	require.Len(t, events, 3)
+	for n, id := range ids {
+		require.Equal(t, cacheUnique, events[n]["cache"])
+		require.Equal(t, id, events[n]["issuance_id"])
+	}
+}
+
+func TestCredKeyWithScopes(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := salt.NewSalt(ctx, &logical.InmemStorage{}, nil)
+	require.NoError(t, err)
+
+	key := credKey(s, "user")
+	scopeKey := func(scopes ...string) string {
+		set, err := newScopeSet(scopes)
+		require.NoError(t, err)
+		return credKeyWithScopes(s, key, set, false)
+	}
+
+	// Scopes are a set
+	require.Equal(t, scopeKey("a", "b"), scopeKey("b", " a ", "a"))
+	require.Equal(t, scopeKey(), scopeKey(""))
+
+	// Scopes containing separators don't collide
+	require.NotEqual(t, scopeKey("a", "b"), scopeKey("a,b"))
+	require.NotEqual(t, scopeKey("a;1:b"), scopeKey("a", "b"))
+
+	// DPoP-bound tokens are kept apart from bearer tokens
+	require.NotEqual(t, credKeyWithScopes(s, key, nil, false), credKeyWithScopes(s, key, nil, true))
+
+	// Keys depend on the salt of the mount
+	other, err := salt.NewSalt(ctx, &logical.InmemStorage{}, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, key, credKey(other, "user"))
+}
+
+func TestTokenReadScopeTemplates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var scopes []string
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		scopes = append(scopes, data.Get("scope"))
+
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, i)))
+		i++
+	})
+
+	entity := &logical.Entity{ID: "entity1", Name: "team-a", Metadata: map[string]string{"tenant": "t1"}}
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{
+		System: &logical.StaticSystemView{EntityVal: entity},
+	}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"scopes":        "read,tenant:{{identity.entity.metadata.tenant}},{{identity.entity.name}}",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Scopes are rendered for the requesting entity
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/test",
+		Storage:   storage,
+		EntityID:  "entity1",
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.Equal(t, []string{"read team-a tenant:t1"}, scopes)
+
+	// Token is cached for the rendered scopes
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Other rendered scopes use another token
+	entity.Metadata["tenant"] = "t2"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+	require.Equal(t, "read team-a tenant:t2", scopes[1])
+
+	// Overridden scopes are not rendered
+	read.Data = map[string]interface{}{"scopes": "read"}
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+	require.Equal(t, "read", scopes[2])
+	read.Data = nil
+
+	// Values that would add scopes are rejected
+	entity.Metadata["tenant"] = "t1 admin"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Invalid scopes: scope "tenant:{{identity.entity.metadata.tenant}}" renders to invalid scope "tenant:t1 admin"`)
+
+	// Missing values are rejected
+	delete(entity.Metadata, "tenant")
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Invalid scopes: scope "tenant:{{identity.entity.metadata.tenant}}" references metadata "tenant", which is not set on the entity`)
+
+	// Requests without an entity are rejected
+	read.EntityID = ""
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid scopes: scope templates require a request associated with an identity entity")
+
+	require.Len(t, scopes, 3)
+
+	// Unsupported and malformed templates are rejected
+	for _, scope := range []string{"{{identity.entity.aliases}}", "{{identity.entity.metadata.}}", "tenant:{{identity.entity.id", "{{identity.entity.id}}}}"} {
+		write.Data["scopes"] = scope
+		resp, err = backend.HandleRequest(ctx, write)
+		require.NoError(t, err)
+		require.Error(t, resp.Error(), scope)
+	}
+
+	// Templates can't contain whitespace, as scopes are split on it
+	write.Data["scopes"] = "tenant:{{ identity.entity.id }}"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Invalid scopes: scope "tenant:{{ identity.entity.id }}" contains whitespace inside template "{{ identity.entity.id }}"`)
+}
+
+func TestTokenReadAllowedScopes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var scopes []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		scopes = append(scopes, data.Get("scope"))
+
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"scopes":        "read",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Any scope may be requested by default
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/test",
+		Storage:   storage,
+		Data:      map[string]interface{}{"scopes": "admin"},
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, []string{"admin"}, scopes)
+
+	// Requested scopes must match the allowed scopes
+	write.Data["allowed_scopes"] = "read,repo:*"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Invalid scopes: scope "admin" does not match any of the allowed scopes`)
+
+	read.Data["scopes"] = "read,repo:status"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "read repo:status", scopes[1])
+
+	// Requesting no scopes would bypass the allowed scopes
+	read.Data["scopes"] = ""
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid scopes: at least one scope must be requested when allowed scopes are configured")
+	require.Len(t, scopes, 2)
+
+	// Overrides can be disabled
+	read.Data["scopes"] = "read,repo:status"
+	write.Data["allow_scope_override"] = false
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid scopes: overriding default scopes is not allowed")
+
+	// Default scopes are still available
+	read.Data = nil
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "read", scopes[2])
+	require.Len(t, scopes, 3)
+}
+
+func TestTokenReadMaxTTL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=86400`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"max_ttl":       "1h",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Expiry is limited to max_ttl
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/test",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.InDelta(t, 3600, resp.Data["ttl"], 10)
+	require.WithinDuration(t, time.Now().Add(time.Hour), resp.Data["expires"].(time.Time), 10*time.Second)
+
+	// Cached tokens keep the limited expiry
+	expires := resp.Data["expires"]
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.True(t, expires.(time.Time).Equal(resp.Data["expires"].(time.Time)))
+
+	// Tokens expiring earlier are not affected
+	write.Data["max_ttl"] = "48h"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	read.Data = map[string]interface{}{"force_refresh": true}
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+	require.InDelta(t, 86400, resp.Data["ttl"], 10)
+
+	// Lowering max_ttl refreshes cached tokens expiring later
+	write.Data["max_ttl"] = "1h"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	read.Data = nil
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+	require.InDelta(t, 3600, resp.Data["ttl"], 10)
+
+	// Values too short to use tokens are rejected
+	write.Data["max_ttl"] = 5
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Max TTL must be zero or at least 1m0s")
+}
+
+func TestTokenReadDefaultTTL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Tokens without an expiry never expire by default
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/test",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.True(t, resp.Data["expires"].(time.Time).IsZero())
+	require.Equal(t, int64(0), resp.Data["ttl"])
+
+	// Tokens stored without an expiry are replaced once default_ttl is set
+	write.Data["default_ttl"] = "1h"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+	require.InDelta(t, 3600, resp.Data["ttl"], 10)
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+
+	// max_ttl still applies
+	write.Data["max_ttl"] = "30m"
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	read.Data = map[string]interface{}{"force_refresh": true}
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+	require.InDelta(t, 1800, resp.Data["ttl"], 10)
+
+	// Values too short to use tokens are rejected
+	write.Data["default_ttl"] = 5
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Default TTL must be zero or at least 1m0s")
+}
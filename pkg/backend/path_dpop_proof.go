@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const dpopProofPathSuffix = "/dpop-proof"
+
+func (b *backend) dpopProofUpdateOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return logical.ErrorResponse("Not configured"), nil
+	} else if !c.DPoP {
+		return logical.ErrorResponse("DPoP is not enabled"), nil
+	}
+
+	method := strings.ToUpper(data.Get("method").(string))
+	if method == "" {
+		return logical.ErrorResponse("Missing method"), nil
+	}
+
+	target := data.Get("url").(string)
+	if u, err := url.Parse(target); err != nil || !u.IsAbs() {
+		return logical.ErrorResponse("Invalid URL"), nil
+	}
+
+	bound, err := b.boundName(req, c, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := b.getDPoPKey(ctx, req.Storage, dpopKeyPath(s, bound))
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := dpopProof(pk, method, target, data.Get("nonce").(string), data.Get("access_token").(string), b.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"proof": proof,
+		},
+	}
+	return resp, nil
+}
+
+var dpopProofFields = map[string]*framework.FieldSchema{
+	"name": {
+		Type:        framework.TypeString,
+		Description: "Specifies the name of the credential.",
+	},
+	"method": {
+		Type:        framework.TypeString,
+		Description: "Specifies the HTTP method of the request the proof is for.",
+	},
+	"url": {
+		Type:        framework.TypeString,
+		Description: "Specifies the URL of the request the proof is for.",
+	},
+	"nonce": {
+		Type:        framework.TypeString,
+		Description: "Specifies the nonce provided by the resource server.",
+	},
+	"access_token": {
+		Type:        framework.TypeString,
+		Description: "Specifies the access token the proof is bound to.",
+	},
+}
+
+const dpopProofHelpSynopsis = `
+Signs DPoP proofs for requests to resource servers.
+`
+
+const dpopProofHelpDescription = `
+This endpoint signs a DPoP proof (RFC 9449) for an HTTP request with the key
+pair of the credential. Access tokens of the credential are bound to the same
+key pair, so clients can present them to resource servers without holding the
+private key.
+`
+
+func pathDPoPProof(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: credsPathPrefix + credentialNameRegex("name") + dpopProofPathSuffix + `$`,
+		Fields:  dpopProofFields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.dpopProofUpdateOperation,
+				Summary:  "Sign a DPoP proof for a request.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(dpopProofHelpSynopsis),
+		HelpDescription: strings.TrimSpace(dpopProofHelpDescription),
+	}
+}
@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// verifyDPoPProof checks the signature of a DPoP proof against its embedded
+// key and returns the key thumbprint and claims.
+func verifyDPoPProof(t *testing.T, proof string) (string, *dpopClaims) {
+	jws, err := jose.ParseSigned(proof)
+	require.NoError(t, err)
+	require.Len(t, jws.Signatures, 1)
+
+	header := jws.Signatures[0].Header
+	require.Equal(t, dpopProofType, header.ExtraHeaders[jose.HeaderType])
+	require.NotNil(t, header.JSONWebKey)
+	require.True(t, header.JSONWebKey.IsPublic())
+
+	payload, err := jws.Verify(header.JSONWebKey)
+	require.NoError(t, err)
+
+	claims := &dpopClaims{}
+	require.NoError(t, json.Unmarshal(payload, claims))
+	require.NotEmpty(t, claims.ID)
+	require.InDelta(t, time.Now().Unix(), claims.IssuedAt, 60)
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), claims
+}
+
+func TestDPoP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var thumbprints []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		thumbprint, claims := verifyDPoPProof(t, r.Header.Get(dpopHeader))
+		assert.Equal(t, http.MethodPost, claims.Method)
+		assert.Equal(t, "http://localhost/token", claims.URL)
+		assert.Empty(t, claims.AccessTokenHash)
+		thumbprints = append(thumbprints, thumbprint)
+
+		// Require a nonce
+		w.Header().Set("Content-Type", "application/json")
+		if claims.Nonce != "server-nonce" {
+			w.Header().Set(dpopNonceHeader, "server-nonce")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"use_dpop_nonce"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"abcd","token_type":"DPoP","expires_in":3600}`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Proofs require DPoP to be enabled
+	proof := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      credsPath + "/user" + dpopProofPathSuffix,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"method":       "get",
+			"url":          "https://api.example.com/resource?id=1#top",
+			"access_token": "abcd",
+		},
+	}
+
+	resp, err = backend.HandleRequest(ctx, proof)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "DPoP is not enabled")
+
+	write.Data["dpop"] = true
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+
+	// The request was repeated with the nonce using the same key
+	require.Len(t, thumbprints, 2)
+	require.Equal(t, thumbprints[0], thumbprints[1])
+
+	// Sign a proof for a resource server
+	resp, err = backend.HandleRequest(ctx, proof)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	thumbprint, claims := verifyDPoPProof(t, resp.Data["proof"].(string))
+	require.Equal(t, thumbprints[0], thumbprint)
+	require.Equal(t, http.MethodGet, claims.Method)
+	require.Equal(t, "https://api.example.com/resource", claims.URL)
+
+	ath := sha256.Sum256([]byte("abcd"))
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(ath[:]), claims.AccessTokenHash)
+
+	// Other credentials use a different key
+	proof.Path = credsPath + "/user2" + dpopProofPathSuffix
+	resp, err = backend.HandleRequest(ctx, proof)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	thumbprint, _ = verifyDPoPProof(t, resp.Data["proof"].(string))
+	require.NotEqual(t, thumbprints[0], thumbprint)
+
+	// Deleting the credential removes its key
+	delete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, delete)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, dpopKeysPathPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
+
+func TestDPoPToggle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get(dpopHeader) != "" {
+			w.Write([]byte(`{"access_token":"dpop","token_type":"DPoP","expires_in":3600}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"bearer","token_type":"Bearer","expires_in":3600}`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	// Cached tokens are never returned after toggling DPoP
+	for _, dpop := range []bool{false, true, false} {
+		write.Data["dpop"] = dpop
+		resp, err := backend.HandleRequest(ctx, write)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		expected := "bearer"
+		if dpop {
+			expected = "dpop"
+		}
+
+		resp, err = backend.HandleRequest(ctx, read)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+		require.Equal(t, expected, resp.Data["access_token"], "dpop %t", dpop)
+	}
+}
@@ -0,0 +1,183 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
+)
+
+const (
+	eventsPath = "events"
+
+	// maxEventsBufferSize bounds the number of events kept in the single
+	// storage entry backing the ring buffer.
+	maxEventsBufferSize = 1000
+)
+
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+
+	// cacheUnique marks tokens issued for a single request, bypassing the
+	// cache.
+	cacheUnique = "unique"
+)
+
+// tokenEvent records a single token retrieval. It never contains the token
+// itself.
+type tokenEvent struct {
+	Time            time.Time `json:"time"`
+	Name            string    `json:"name"`
+	RequestedScopes []string  `json:"requested_scopes"`
+	GrantedScopes   []string  `json:"granted_scopes,omitempty"`
+	Cache           string    `json:"cache"`
+	Expires         time.Time `json:"expires,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	IssuanceID      string    `json:"issuance_id,omitempty"`
+}
+
+type eventLog struct {
+	Events []*tokenEvent `json:"events"`
+}
+
+func getEvents(ctx context.Context, storage logical.Storage) (*eventLog, error) {
+	entry, err := storage.Get(ctx, eventsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &eventLog{}
+	if entry == nil {
+		return l, nil
+	}
+
+	if err := entry.DecodeJSON(l); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// recordEvent completes the event with the outcome of a token retrieval, logs
+// it and, unless the token came from the cache, appends it to the events
+// buffer if enabled. Cache hits are not stored, so that reading a cached token
+// never writes to storage.
+func (b *backend) recordEvent(ctx context.Context, storage logical.Storage, c *config, ev *tokenEvent, tok *oauth2.Token, err error) {
+	ev.Time = b.clock.Now()
+	if err != nil {
+		ev.Error = errorCode(err)
+	} else if tok != nil {
+		ev.Expires = tok.Expiry
+		if scope, ok := tok.Extra("scope").(string); ok && (ev.Cache == cacheMiss || ev.Cache == cacheUnique) {
+			ev.GrantedScopes = strings.Fields(scope)
+		}
+	}
+
+	args := []interface{}{
+		"name", ev.Name,
+		"requested_scopes", ev.RequestedScopes,
+		"granted_scopes", ev.GrantedScopes,
+		"cache", ev.Cache,
+		"expires", ev.Expires,
+	}
+	if ev.IssuanceID != "" {
+		args = append(args, "issuance_id", ev.IssuanceID)
+	}
+
+	switch {
+	case ev.Error != "":
+		b.logger.Warn("Token retrieval failed", append(args, "error", ev.Error)...)
+	case ev.Cache == cacheHit:
+		b.logger.Debug("Token retrieved from cache", args...)
+	default:
+		b.logger.Info("Token issued", args...)
+	}
+
+	if c.EventsBufferSize <= 0 || ev.Cache == cacheHit {
+		return
+	}
+
+	if err := b.appendEvent(ctx, storage, c.EventsBufferSize, ev); err != nil {
+		b.logger.Warn("Failed to store token event", "error", err)
+	}
+}
+
+func (b *backend) appendEvent(ctx context.Context, storage logical.Storage, size int, ev *tokenEvent) error {
+	b.eventsMut.Lock()
+	defer b.eventsMut.Unlock()
+
+	l, err := getEvents(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	l.Events = append(l.Events, ev)
+	if len(l.Events) > size {
+		l.Events = l.Events[len(l.Events)-size:]
+	}
+
+	entry, err := logical.StorageEntryJSON(eventsPath, l)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+func (b *backend) eventsReadOperation(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	l, err := getEvents(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]map[string]interface{}, len(l.Events))
+	for i, ev := range l.Events {
+		events[i] = map[string]interface{}{
+			"time":             ev.Time,
+			"name":             ev.Name,
+			"requested_scopes": ev.RequestedScopes,
+			"granted_scopes":   ev.GrantedScopes,
+			"cache":            ev.Cache,
+			"expires":          ev.Expires,
+			"error":            ev.Error,
+			"issuance_id":      ev.IssuanceID,
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"events": events,
+		},
+	}
+	return resp, nil
+}
+
+const eventsHelpSynopsis = `
+Lists recent token retrievals.
+`
+
+const eventsHelpDescription = `
+This endpoint returns the most recent token retrievals that didn't return a
+cached token, recorded when events_buffer_size is configured, including the
+credential name, the requested and granted scopes and whether a new token was
+issued. Tokens are never recorded.
+`
+
+func pathEvents(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: eventsPath + `$`,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.eventsReadOperation,
+				Summary:  "Return recent token retrievals.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(eventsHelpSynopsis),
+		HelpDescription: strings.TrimSpace(eventsHelpDescription),
+	}
+}
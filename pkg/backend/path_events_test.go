@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fail := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_scope"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"secret-token","token_type":"bearer","expires_in":3600,"scope":"a"}`))
+	})
+
+	var logs bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{
+		Output:     &logs,
+		Level:      hclog.Debug,
+		JSONFormat: true,
+	})
+
+	storage := &logical.InmemStorage{}
+	backend := new(Options{Logger: logger, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, backend.Setup(ctx, &logical.BackendConfig{}))
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":          "foo",
+			"client_secret":      "bar",
+			"token_url":          "http://localhost/token",
+			"scopes":             "a,b",
+			"events_buffer_size": 2,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	for _, name := range []string{"user", "user", "user3"} {
+		read.Path = credsPath + "/" + name
+		resp, err = backend.HandleRequest(ctx, read)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	}
+
+	fail = true
+	read.Path = credsPath + "/user2"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid client credentials")
+
+	// Read events
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      eventsPath,
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	// Cache hits are not recorded and the oldest event is dropped from the
+	// buffer
+	events := resp.Data["events"].([]map[string]interface{})
+	require.Len(t, events, 2)
+
+	require.Equal(t, "user3", events[0]["name"])
+	require.Equal(t, cacheMiss, events[0]["cache"])
+	require.Equal(t, []string{"a", "b"}, events[0]["requested_scopes"])
+	require.Equal(t, []string{"a"}, events[0]["granted_scopes"])
+	require.Empty(t, events[0]["error"])
+
+	require.Equal(t, "user2", events[1]["name"])
+	require.Equal(t, cacheMiss, events[1]["cache"])
+	require.Equal(t, "invalid_scope", events[1]["error"])
+
+	// Issued token is logged with granted scopes
+	var issued map[string]interface{}
+	for _, line := range bytes.Split(logs.Bytes(), []byte("\n")) {
+		var l map[string]interface{}
+		if json.Unmarshal(line, &l) == nil && l["@message"] == "Token issued" {
+			issued = l
+		}
+	}
+	require.NotNil(t, issued)
+	require.Equal(t, "user3", issued["name"])
+	require.Equal(t, []interface{}{"a"}, issued["granted_scopes"])
+
+	// Token never appears in logs or events
+	entry, err := storage.Get(ctx, eventsPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(entry.Value), "secret-token")
+	require.NotContains(t, logs.String(), "secret-token")
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	exchangePath       = "exchange"
+	exchangePathPrefix = exchangePath + "/"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// exchangeKey identifies a token exchanged for the given subject token,
+// audiences, requested token type, scopes and DPoP mode. The subject token
+// itself is only stored hashed.
+func exchangeKey(s *salt.Salt, name, subjectToken, subjectTokenType string, audience []string, requestedTokenType string, scopes scopeSet, dpop bool) string {
+	parts := encodeStrings(subjectToken, subjectTokenType, encodeSet(audience), requestedTokenType, encodeStrings(scopes...))
+	return hashedKey(s, exchangePathPrefix, name) + "/" + s.GetHMAC(dpopKeyParts(parts, dpop))
+}
+
+func (b *backend) exchangeUpdateOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return logical.ErrorResponse("Not configured"), nil
+	}
+
+	defer b.metrics.MeasureSinceWithLabels([]string{"oauth", "exchange", "update"}, time.Now(), metricLabels(req.MountPoint, c))
+
+	subjectToken := data.Get("subject_token").(string)
+	if subjectToken == "" {
+		return logical.ErrorResponse("Missing subject token"), nil
+	}
+
+	subjectTokenType := data.Get("subject_token_type").(string)
+	audience := data.Get("audience").([]string)
+
+	scopes, err := b.requestedScopes(req, c, data)
+	if err != nil {
+		return scopesErrorResponse(err)
+	}
+
+	params := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {subjectTokenType},
+	}
+	if len(audience) > 0 {
+		params["audience"] = audience
+	}
+	requestedTokenType := data.Get("requested_token_type").(string)
+	if requestedTokenType != "" {
+		params.Set("requested_token_type", requestedTokenType)
+	}
+
+	name := data.Get("name").(string)
+	bound, err := b.boundName(req, c, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, stale, err := b.getToken(ctx, req, c, &tokenRequest{
+		name:    name,
+		key:     exchangeKey(s, bound, subjectToken, subjectTokenType, audience, requestedTokenType, scopes, c.DPoP),
+		scopes:  scopes,
+		params:  params,
+		dpopKey: dpopKeyPath(s, bound),
+	})
+	if err != nil {
+		return tokenErrorResponse(err)
+	}
+
+	return tokenResponse(tok, stale, b.clock.Now())
+}
+
+func (b *backend) exchangeDeleteOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, err := b.deleteName(ctx, req, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.deleteTokens(ctx, req.Storage, hashedKey(s, exchangePathPrefix, name)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+var exchangeFields = map[string]*framework.FieldSchema{
+	"name": {
+		Type:        framework.TypeString,
+		Description: "Specifies the name of the credential.",
+	},
+	"subject_token": {
+		Type:        framework.TypeString,
+		Description: "Specifies the token to exchange.",
+	},
+	"subject_token_type": {
+		Type:        framework.TypeString,
+		Description: "Specifies the type of the subject token.",
+		Default:     tokenTypeJWT,
+	},
+	"audience": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of audiences the token is requested for.",
+	},
+	"requested_token_type": {
+		Type:        framework.TypeString,
+		Description: "Specifies the type of the requested token.",
+	},
+	"scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of scopes for the token to override default scopes from config.",
+	},
+}
+
+const exchangeHelpSynopsis = `
+Exchanges a subject token for an access token.
+`
+
+const exchangeHelpDescription = `
+This endpoint exchanges a subject token for an access token for another
+audience using the OAuth 2.0 token exchange grant (RFC 8693). The mount's
+client credentials authenticate the request. Tokens are cached per subject
+token, audience, requested token type and scopes, and removed periodically
+once expired.
+`
+
+func pathExchange(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: exchangePathPrefix + credentialNameRegex("name") + `$`,
+		Fields:  exchangeFields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.exchangeUpdateOperation,
+				Summary:  "Exchange a subject token for an access token.",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.exchangeDeleteOperation,
+				Summary:  "Remove all exchanged tokens of a credential.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(exchangeHelpSynopsis),
+		HelpDescription: strings.TrimSpace(exchangeHelpDescription),
+	}
+}
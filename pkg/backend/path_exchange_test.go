@@ -0,0 +1,273 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenExchange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	var requestedTokenTypes []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "foo", user)
+		assert.Equal(t, "bar", pass)
+
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		assert.Equal(t, grantTypeTokenExchange, data.Get("grant_type"))
+		assert.Equal(t, tokenTypeJWT, data.Get("subject_token_type"))
+		assert.ElementsMatch(t, []string{"api1", "api2"}, data["audience"])
+		assert.Equal(t, "read", data.Get("scope"))
+		assert.Regexp(t, `^subject\d$`, data.Get("subject_token"))
+		requestedTokenTypes = append(requestedTokenTypes, data.Get("requested_token_type"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"access_token":"abcd%d","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":3600}`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"scopes":        "read",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Exchange token
+	exchange := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      exchangePath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"subject_token": "subject1",
+			"audience":      "api1,api2",
+		},
+	}
+
+	resp, err = backend.HandleRequest(ctx, exchange)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+	require.NotEmpty(t, resp.Data["expires"])
+
+	// Same subject token and audience is cached
+	exchange.Data["audience"] = "api2,api1"
+	resp, err = backend.HandleRequest(ctx, exchange)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Different subject token is exchanged again
+	exchange.Data["subject_token"] = "subject2"
+	resp, err = backend.HandleRequest(ctx, exchange)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+
+	// Different requested token type is exchanged again
+	exchange.Data["requested_token_type"] = "urn:ietf:params:oauth:token-type:id_token"
+	resp, err = backend.HandleRequest(ctx, exchange)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+	require.Equal(t, []string{"", "", "urn:ietf:params:oauth:token-type:id_token"}, requestedTokenTypes)
+
+	// Subject token is never stored
+	keys, err := logical.CollectKeys(ctx, storage)
+	require.NoError(t, err)
+	for _, key := range keys {
+		entry, err := storage.Get(ctx, key)
+		require.NoError(t, err)
+		require.NotContains(t, key, "subject")
+		require.NotContains(t, string(entry.Value), "subject")
+	}
+
+	// Exchanged tokens are separate from credentials
+	keys, err = logical.CollectKeysWithPrefix(ctx, storage, credsPathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// Delete exchanged tokens
+	delete := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      exchangePath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, delete)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	keys, err = logical.CollectKeysWithPrefix(ctx, storage, exchangePathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestTokenExchangeMissingSubjectToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	storage := &logical.InmemStorage{}
+	backend, err := Factory(ctx, &logical.BackendConfig{})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      exchangePath + "/user",
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Missing subject token")
+}
+
+func TestTokenExchangeTidy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		// Tokens for the first subject token expire first
+		expiresIn := 3600
+		if data.Get("subject_token") == "subject2" {
+			expiresIn = 7200
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"access_token":"abcd","token_type":"Bearer","expires_in":%d}`, expiresIn)))
+	})
+
+	clk := &fakeClock{now: time.Now()}
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Clock: clk, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":      "foo",
+			"client_secret":  "bar",
+			"token_url":      "http://localhost/token",
+			"stale_if_error": "10m",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	for _, subjectToken := range []string{"subject1", "subject2"} {
+		resp, err = backend.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      exchangePath + "/user",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"subject_token": subjectToken,
+			},
+		})
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	}
+
+	tidy := &logical.Request{
+		Operation: logical.RollbackOperation,
+		Storage:   storage,
+	}
+
+	// Expired tokens are kept while they can be returned as stale tokens
+	clk.Add(65 * time.Minute)
+	_, err = backend.HandleRequest(ctx, tidy)
+	require.NoError(t, err)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, exchangePathPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	// Only expired tokens are removed
+	clk.Add(10 * time.Minute)
+	_, err = backend.HandleRequest(ctx, tidy)
+	require.NoError(t, err)
+
+	keys, err = logical.CollectKeysWithPrefix(ctx, storage, exchangePathPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	clk.Add(time.Hour)
+	_, err = backend.HandleRequest(ctx, tidy)
+	require.NoError(t, err)
+
+	keys, err = logical.CollectKeysWithPrefix(ctx, storage, exchangePathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestTokenTidyable(t *testing.T) {
+	now := time.Now()
+	c := &config{StaleIfError: 10 * time.Minute}
+
+	require.True(t, tokenTidyable(c, nil, now))
+	require.False(t, tokenTidyable(c, &oauth2.Token{AccessToken: "abcd", Expiry: now.Add(-time.Minute)}, now))
+	require.True(t, tokenTidyable(c, &oauth2.Token{AccessToken: "abcd", Expiry: now.Add(-10 * time.Minute)}, now))
+
+	// Tokens without an expiry are only removed if default_ttl is set, as
+	// they are never returned then
+	require.False(t, tokenTidyable(c, &oauth2.Token{AccessToken: "abcd"}, now))
+	c.DefaultTTL = time.Hour
+	require.True(t, tokenTidyable(c, &oauth2.Token{AccessToken: "abcd"}, now))
+}
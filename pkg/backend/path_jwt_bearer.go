@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	jwtBearerPath       = "jwt-bearer"
+	jwtBearerPathPrefix = jwtBearerPath + "/"
+)
+
+const (
+	grantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// jwtBearerKey identifies a token obtained with the given assertion, scopes
+// and DPoP mode for an entity. Tokens are cached per assertion, as its signature is only
+// verified by the token endpoint: a forged assertion for the entity must not
+// return a token obtained with a genuine one. The assertion is only stored
+// hashed.
+func jwtBearerKey(s *salt.Salt, entityID, assertion string, scopes scopeSet, dpop bool) string {
+	parts := encodeStrings(assertion, encodeStrings(scopes...))
+	return hashedKey(s, jwtBearerPathPrefix, entityID) + "/" + s.GetHMAC(dpopKeyParts(parts, dpop))
+}
+
+// assertionAudiences returns the audiences of which an assertion must be
+// issued for at least one, defaulting to the token URL.
+func assertionAudiences(c *config) []string {
+	if len(c.JWTBearerAudiences) > 0 {
+		return c.JWTBearerAudiences
+	}
+
+	return []string{c.TokenURL}
+}
+
+// checkAssertion verifies that the assertion is a JWT issued for the given
+// entity and one of the audiences that is valid at the given time. The
+// signature is verified by the token endpoint.
+func checkAssertion(assertion, entityID string, audiences []string, now time.Time) error {
+	tok, err := jwt.ParseSigned(assertion)
+	if err != nil {
+		return errInvalidAssertion
+	}
+
+	claims := jwt.Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return errInvalidAssertion
+	}
+
+	if claims.Subject != entityID {
+		return errAssertionSubjectMismatch
+	}
+
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: now}, 0); err != nil {
+		return errInvalidAssertion
+	}
+
+	for _, aud := range audiences {
+		if claims.Audience.Contains(aud) {
+			return nil
+		}
+	}
+
+	return errAssertionAudience
+}
+
+func (b *backend) jwtBearerUpdateOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return logical.ErrorResponse("Not configured"), nil
+	}
+
+	defer b.metrics.MeasureSinceWithLabels([]string{"oauth", "jwt_bearer", "update"}, time.Now(), metricLabels(req.MountPoint, c))
+
+	if req.EntityID == "" {
+		return logical.ErrorResponse("Request is not associated with an identity entity"), nil
+	}
+
+	assertion := data.Get("assertion").(string)
+	if assertion == "" {
+		return logical.ErrorResponse("Missing assertion"), nil
+	}
+
+	if err := checkAssertion(assertion, req.EntityID, assertionAudiences(c), b.clock.Now()); err == errAssertionSubjectMismatch {
+		return nil, logical.ErrPermissionDenied
+	} else if err == errAssertionAudience {
+		return logical.ErrorResponse("Assertion audience does not match"), nil
+	} else if err != nil {
+		return logical.ErrorResponse("Invalid assertion"), nil
+	}
+
+	scopes, err := b.requestedScopes(req, c, data)
+	if err != nil {
+		return scopesErrorResponse(err)
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, stale, err := b.getToken(ctx, req, c, &tokenRequest{
+		name:   req.EntityID,
+		key:    jwtBearerKey(s, req.EntityID, assertion, scopes, c.DPoP),
+		scopes: scopes,
+		params: url.Values{
+			"grant_type": {grantTypeJWTBearer},
+			"assertion":  {assertion},
+		},
+		dpopKey: dpopKeyPath(s, req.EntityID),
+	})
+	if err != nil {
+		return tokenErrorResponse(err)
+	}
+
+	return tokenResponse(tok, stale, b.clock.Now())
+}
+
+func (b *backend) jwtBearerDeleteOperation(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if req.EntityID == "" {
+		return logical.ErrorResponse("Request is not associated with an identity entity"), nil
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.deleteTokens(ctx, req.Storage, hashedKey(s, jwtBearerPathPrefix, req.EntityID)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+var jwtBearerFields = map[string]*framework.FieldSchema{
+	"assertion": {
+		Type:        framework.TypeString,
+		Description: "Specifies the Vault identity token of the requesting entity.",
+	},
+	"scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of scopes for the token to override default scopes from config.",
+	},
+}
+
+const jwtBearerHelpSynopsis = `
+Provides access tokens for the requesting identity entity.
+`
+
+const jwtBearerHelpDescription = `
+This endpoint exchanges a Vault identity token of the requesting entity for
+an access token using the JWT bearer grant (RFC 7523). The subject of the
+identity token must match the entity of the request and its audience one of
+the configured JWT bearer audiences. Tokens are cached per entity, identity
+token and scopes, and removed periodically once expired.
+`
+
+func pathJWTBearer(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: jwtBearerPath + `$`,
+		Fields:  jwtBearerFields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.jwtBearerUpdateOperation,
+				Summary:  "Get a current access token for the requesting entity.",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.jwtBearerDeleteOperation,
+				Summary:  "Remove the tokens of the requesting entity.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(jwtBearerHelpSynopsis),
+		HelpDescription: strings.TrimSpace(jwtBearerHelpDescription),
+	}
+}
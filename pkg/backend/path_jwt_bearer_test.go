@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func identityToken(t *testing.T, entityID, audience string, expiry time.Time) string {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	require.NoError(t, err)
+
+	tok, err := jwt.Signed(sig).Claims(jwt.Claims{
+		Issuer:   "https://vault.example.com/v1/identity/oidc",
+		Subject:  entityID,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(expiry),
+	}).CompactSerialize()
+	require.NoError(t, err)
+
+	return tok
+}
+
+func TestJWTBearer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	i := 1
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		data, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+
+		assert.Equal(t, grantTypeJWTBearer, data.Get("grant_type"))
+		assert.NotEmpty(t, data.Get("assertion"))
+
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, i)))
+		i++
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":            "foo",
+			"client_secret":        "bar",
+			"token_url":            "http://localhost/token",
+			"jwt_bearer_audiences": "other,provider",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Request token
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      jwtBearerPath,
+		Storage:   storage,
+		EntityID:  "entity1",
+		Data: map[string]interface{}{
+			"assertion": identityToken(t, "entity1", "provider", time.Now().Add(time.Minute)),
+		},
+	}
+
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Token is cached per assertion
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// Another assertion of the entity, possibly forged, never returns the
+	// cached token
+	request.Data["assertion"] = identityToken(t, "entity1", "provider", time.Now().Add(2*time.Minute))
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+
+	// Another entity gets its own token
+	request.EntityID = "entity2"
+	request.Data["assertion"] = identityToken(t, "entity2", "provider", time.Now().Add(time.Minute))
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd3", resp.Data["access_token"])
+
+	// Assertion of another entity is rejected
+	request.Data["assertion"] = identityToken(t, "entity1", "provider", time.Now().Add(time.Minute))
+	_, err = backend.HandleRequest(ctx, request)
+	require.Equal(t, logical.ErrPermissionDenied, err)
+
+	// Assertion for another audience is rejected
+	request.Data["assertion"] = identityToken(t, "entity2", "http://localhost/token", time.Now().Add(time.Minute))
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Assertion audience does not match")
+
+	// Expired assertion is rejected
+	request.Data["assertion"] = identityToken(t, "entity2", "provider", time.Now().Add(-time.Minute))
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid assertion")
+
+	// Malformed assertion is rejected
+	request.Data["assertion"] = "not a jwt"
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid assertion")
+
+	// Requests without an entity are rejected
+	request.EntityID = ""
+	resp, err = backend.HandleRequest(ctx, request)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Request is not associated with an identity entity")
+
+	// Delete tokens of the entity
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      jwtBearerPath,
+		Storage:   storage,
+		EntityID:  "entity1",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, jwtBearerPathPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
+
+func TestAssertionAudience(t *testing.T) {
+	now := time.Now()
+	c := &config{TokenURL: "http://localhost/token"}
+
+	// Assertions must be issued for the token URL by default
+	assertion := identityToken(t, "entity1", "http://localhost/token", now.Add(time.Minute))
+	require.NoError(t, checkAssertion(assertion, "entity1", assertionAudiences(c), now))
+
+	assertion = identityToken(t, "entity1", "provider", now.Add(time.Minute))
+	require.Equal(t, errAssertionAudience, checkAssertion(assertion, "entity1", assertionAudiences(c), now))
+
+	// Configured audiences replace the token URL
+	c.JWTBearerAudiences = []string{"provider"}
+	require.NoError(t, checkAssertion(assertion, "entity1", assertionAudiences(c), now))
+
+	assertion = identityToken(t, "entity1", "http://localhost/token", now.Add(time.Minute))
+	require.Equal(t, errAssertionAudience, checkAssertion(assertion, "entity1", assertionAudiences(c), now))
+}
@@ -0,0 +1,261 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	proxyPath       = "proxy"
+	proxyPathPrefix = proxyPath + "/"
+
+	// maxProxyResponseSize bounds the size of a response body returned by
+	// the proxy endpoint.
+	maxProxyResponseSize = 10 << 20
+)
+
+// proxyKey derives the key tokens of the proxy are stored under. They are
+// kept apart from the tokens of the creds endpoint, so that they never leave
+// Vault.
+func proxyKey(s *salt.Salt, name string) string {
+	return hashedKey(s, proxyPathPrefix, name)
+}
+
+// proxyURLAllowed reports whether u matches one of the allowed URL patterns.
+// URLs with user information or dot segments are never allowed, as they could
+// be used to reach hosts or paths the patterns don't cover.
+func proxyURLAllowed(allowed []string, u *url.URL) bool {
+	if u.User != nil {
+		return false
+	}
+
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	target := *u
+	target.Fragment = ""
+
+	for _, pattern := range allowed {
+		if strutil.GlobbedStringsMatch(pattern, target.String()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *backend) proxyUpdateOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return logical.ErrorResponse("Not configured"), nil
+	}
+
+	defer b.metrics.MeasureSinceWithLabels([]string{"oauth", "proxy", "request"}, time.Now(), metricLabels(req.MountPoint, c))
+
+	method := strings.ToUpper(data.Get("method").(string))
+
+	u, err := url.Parse(data.Get("url").(string))
+	if err != nil || !u.IsAbs() || (u.Scheme != "https" && u.Scheme != "http") {
+		return logical.ErrorResponse("Invalid URL"), nil
+	} else if !proxyURLAllowed(c.ProxyAllowedURLs, u) {
+		return logical.ErrorResponse(fmt.Sprintf("URL %q is not allowed", u.String())), nil
+	}
+
+	headers := http.Header{}
+	if h, ok := data.GetOk("headers"); ok {
+		headers = h.(http.Header)
+	}
+
+	for name := range headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", dpopHeader:
+			return logical.ErrorResponse(fmt.Sprintf("Header %q is not allowed", name)), nil
+		}
+	}
+
+	var body io.Reader
+	if d := data.Get("body").(string); d != "" {
+		body = strings.NewReader(d)
+	}
+	if d := data.Get("body_base64").(string); d != "" {
+		if body != nil {
+			return logical.ErrorResponse("Only one of body and body_base64 may be set"), nil
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(d)
+		if err != nil {
+			return logical.ErrorResponse("Invalid base64 body"), nil
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	scopes, err := b.requestedScopes(req, c, data)
+	if err != nil {
+		return scopesErrorResponse(err)
+	}
+
+	name := data.Get("name").(string)
+	bound, err := b.boundName(req, c, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := b.getSalt(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, stale, err := b.getToken(ctx, req, c, &tokenRequest{
+		name:    name,
+		key:     credKeyWithScopes(s, proxyKey(s, bound), scopes, c.DPoP),
+		scopes:  scopes,
+		dpopKey: dpopKeyPath(s, bound),
+	})
+	if err != nil {
+		return tokenErrorResponse(err)
+	}
+
+	client := b.httpClient()
+	if c.DPoP {
+		pk, err := b.getDPoPKey(ctx, req.Storage, dpopKeyPath(s, bound))
+		if err != nil {
+			return nil, err
+		}
+		client = dpopClient(client, pk, tok.AccessToken, b.clock)
+	}
+
+	// Redirects are returned to the caller rather than followed, so that
+	// the token is only sent to allowed URLs.
+	pc := *client
+	pc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	rctx := ctx
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	r, err := http.NewRequestWithContext(rctx, method, u.String(), body)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	r.Header = headers
+	r.Header.Set("Authorization", tok.Type()+" "+tok.AccessToken)
+
+	pr, err := pc.Do(r)
+	if err != nil {
+		b.logger.Error("Proxied request failed", "url", u.String(), "error", err)
+		return nil, logical.CodedError(http.StatusBadGateway, errProxyRequestFailed.Error())
+	}
+	defer pr.Body.Close()
+
+	rb, err := ioutil.ReadAll(io.LimitReader(pr.Body, maxProxyResponseSize+1))
+	if err != nil {
+		b.logger.Error("Proxied request failed", "url", u.String(), "error", err)
+		return nil, logical.CodedError(http.StatusBadGateway, errProxyRequestFailed.Error())
+	} else if len(rb) > maxProxyResponseSize {
+		return nil, logical.CodedError(http.StatusBadGateway, errProxyResponseTooLarge.Error())
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"status":  pr.StatusCode,
+			"headers": pr.Header,
+		},
+	}
+
+	// Bodies that are not valid UTF-8 would be mangled when encoded as JSON,
+	// so they are returned base64 encoded instead.
+	if utf8.Valid(rb) {
+		resp.Data["body"] = string(rb)
+	} else {
+		resp.Data["body_base64"] = base64.StdEncoding.EncodeToString(rb)
+	}
+
+	if stale {
+		resp.AddWarning(fmt.Sprintf("Token endpoint unavailable, using a stale token that expires at %s", tok.Expiry.Format(time.RFC3339)))
+	}
+
+	return resp, nil
+}
+
+var proxyFields = map[string]*framework.FieldSchema{
+	"name": {
+		Type:        framework.TypeString,
+		Description: "Specifies the name of the credential.",
+	},
+	"method": {
+		Type:        framework.TypeString,
+		Description: "Specifies the HTTP method of the request.",
+		Default:     http.MethodGet,
+	},
+	"url": {
+		Type:        framework.TypeString,
+		Description: "Specifies the URL of the request.",
+	},
+	"headers": {
+		Type:        framework.TypeHeader,
+		Description: "Specifies the headers of the request.",
+	},
+	"body": {
+		Type:        framework.TypeString,
+		Description: "Specifies the body of the request.",
+	},
+	"body_base64": {
+		Type:        framework.TypeString,
+		Description: "Specifies the base64 encoded body of the request, for bodies that are not text.",
+	},
+	"scopes": {
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Comma separated list of scopes for the token to override default scopes from config.",
+	},
+}
+
+const proxyHelpSynopsis = `
+Sends requests authorized with the token of a credential.
+`
+
+const proxyHelpDescription = `
+This endpoint sends an HTTP request to an allowed URL with the access token of
+the credential attached and returns the response, so that the token never
+leaves Vault. Tokens are not shared with the creds endpoint. Response bodies
+that are not valid UTF-8 are returned base64 encoded in body_base64.
+`
+
+func pathProxy(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: proxyPathPrefix + credentialNameRegex("name") + `$`,
+		Fields:  proxyFields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.proxyUpdateOperation,
+				Summary:  "Send a request with the access token of this credential.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(proxyHelpSynopsis),
+		HelpDescription: strings.TrimSpace(proxyHelpDescription),
+	}
+}
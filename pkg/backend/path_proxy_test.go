@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tokens := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "localhost":
+			tokens++
+			w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, tokens)))
+		case "api.example.com":
+			b, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "/v1/items", r.URL.Path)
+			assert.Equal(t, "Bearer abcd1", r.Header.Get("Authorization"))
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.Equal(t, `{"name":"foo"}`, string(b))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":1}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":          "foo",
+			"client_secret":      "bar",
+			"token_url":          "http://localhost/token",
+			"proxy_allowed_urls": "https://api.example.com/v1/*",
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Send request
+	proxy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      proxyPath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"method": "post",
+			"url":    "https://api.example.com/v1/items",
+			"headers": map[string]interface{}{
+				"Content-Type": "application/json",
+			},
+			"body": `{"name":"foo"}`,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err = backend.HandleRequest(ctx, proxy)
+		require.NoError(t, err)
+		require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+		require.Equal(t, http.StatusCreated, resp.Data["status"])
+		require.Equal(t, "application/json", resp.Data["headers"].(http.Header).Get("Content-Type"))
+		require.Equal(t, `{"id":1}`, resp.Data["body"])
+		require.NotContains(t, resp.Data, "body_base64")
+		require.NotContains(t, resp.Data, "access_token")
+	}
+
+	// The token is cached
+	require.Equal(t, 1, tokens)
+
+	// The token is not shared with creds
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+	require.Equal(t, 2, tokens)
+
+	// Deleting the credential removes the token of the proxy
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, proxyPathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// Caller must not set the authorization header
+	proxy.Data["headers"] = map[string]interface{}{"authorization": "Bearer other"}
+	resp, err = backend.HandleRequest(ctx, proxy)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), `Header "Authorization" is not allowed`)
+}
+
+func TestProxyBinaryBody(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	binary := []byte{0x89, 'P', 'N', 'G', 0xff, 0x00}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "localhost":
+			w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+		case "api.example.com":
+			b, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, binary, b)
+
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(binary)
+		default:
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	resp, err := backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":          "foo",
+			"client_secret":      "bar",
+			"token_url":          "http://localhost/token",
+			"proxy_allowed_urls": "https://api.example.com/v1/*",
+		},
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	proxy := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      proxyPath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"method":      "put",
+			"url":         "https://api.example.com/v1/image",
+			"body_base64": base64.StdEncoding.EncodeToString(binary),
+		},
+	}
+
+	// Bodies that are not valid UTF-8 are passed through base64 encoded
+	resp, err = backend.HandleRequest(ctx, proxy)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.NotContains(t, resp.Data, "body")
+	require.Equal(t, base64.StdEncoding.EncodeToString(binary), resp.Data["body_base64"])
+
+	// Invalid base64
+	proxy.Data["body_base64"] = "not base64!"
+	resp, err = backend.HandleRequest(ctx, proxy)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Invalid base64 body")
+
+	// Only one body may be given
+	proxy.Data["body"] = "text"
+	proxy.Data["body_base64"] = base64.StdEncoding.EncodeToString(binary)
+	resp, err = backend.HandleRequest(ctx, proxy)
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Only one of body and body_base64 may be set")
+}
+
+func TestProxyURLAllowed(t *testing.T) {
+	allowed := []string{"https://api.example.com/v1/*", "https://status.example.com/health"}
+
+	for target, ok := range map[string]bool{
+		"https://api.example.com/v1/items":          true,
+		"https://api.example.com/v1/items?id=1#top": true,
+		"https://status.example.com/health":         true,
+		"https://status.example.com/health/other":   false,
+		"https://api.example.com/v2/items":          false,
+		"https://api.example.com/v1/../v2/items":    false,
+		"https://api.example.com/v1/%2e%2e/v2":      false,
+		"https://user@api.example.com/v1/items":     false,
+		"http://api.example.com/v1/items":           false,
+	} {
+		u, err := url.Parse(target)
+		require.NoError(t, err)
+		require.Equal(t, ok, proxyURLAllowed(allowed, u), target)
+	}
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	statusPath = "status"
+)
+
+// tokenPathPrefixes hold the cached tokens of every endpoint.
+var tokenPathPrefixes = []string{
+	credsPathPrefix,
+	proxyPathPrefix,
+	exchangePathPrefix,
+	jwtBearerPathPrefix,
+}
+
+// fetchStatus tracks the outcome of recent upstream token requests on this
+// node.
+type fetchStatus struct {
+	mut         sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+func (fs *fetchStatus) success(now time.Time) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	fs.lastSuccess = now
+}
+
+func (fs *fetchStatus) failure(code string, now time.Time) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	fs.lastFailure = now
+	fs.lastError = code
+}
+
+func (fs *fetchStatus) data() map[string]interface{} {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	rd := map[string]interface{}{
+		"last_success": nil,
+		"last_failure": nil,
+		"last_error":   fs.lastError,
+	}
+	if !fs.lastSuccess.IsZero() {
+		rd["last_success"] = fs.lastSuccess
+	}
+	if !fs.lastFailure.IsZero() {
+		rd["last_failure"] = fs.lastFailure
+	}
+
+	return rd
+}
+
+func (b *backend) statusReadOperation(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	c, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := 0
+	for _, prefix := range tokenPathPrefixes {
+		keys, err := logical.CollectKeysWithPrefix(ctx, req.Storage, prefix)
+		if err != nil {
+			return nil, err
+		}
+		cached += len(keys)
+	}
+
+	probe := map[string]interface{}{}
+	if c != nil && data.Get("probe").(bool) {
+		// Probe tokens are never stored. Templated scopes are left out, as
+		// there is no entity to render them for.
+		cc := &clientcredentials.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			TokenURL:     c.TokenURL,
+			Scopes:       untemplatedScopes(c.Scopes),
+		}
+		tok, err := b.fetchToken(clientContext(ctx, b.httpClient()), c, cc.Token, b.clock.Now(), metricLabels(req.MountPoint, c))
+
+		probe["probe_success"] = err == nil
+		if err != nil {
+			probe["probe_error"] = errorCode(err)
+		} else {
+			probe["probe_expires"] = tok.Expiry
+		}
+	}
+
+	rd := b.status.data()
+	rd["configured"] = c != nil
+	rd["cached_tokens"] = cached
+	if c != nil {
+		rd["circuit_breaker"] = b.breaker.state(c.CircuitBreakerThreshold, c.CircuitBreakerCooldown, b.clock.Now())
+	}
+	for k, v := range probe {
+		rd[k] = v
+	}
+
+	resp := &logical.Response{
+		Data: rd,
+	}
+	return resp, nil
+}
+
+var statusFields = map[string]*framework.FieldSchema{
+	"probe": {
+		Type:        framework.TypeBool,
+		Description: "Specifies whether to retrieve a token with the default scopes to check the provider.",
+	},
+}
+
+const statusHelpSynopsis = `
+Reports the state of the configured provider.
+`
+
+const statusHelpDescription = `
+This endpoint reports whether the mount is configured, the outcome of recent
+token requests on this node, the circuit breaker state and the number of
+cached tokens. With probe set, a token is requested from the provider
+without being cached.
+`
+
+func pathStatus(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: statusPath + `$`,
+		Fields:  statusFields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.statusReadOperation,
+				Summary:  "Return the state of the configured provider.",
+			},
+		},
+		HelpSynopsis:    strings.TrimSpace(statusHelpSynopsis),
+		HelpDescription: strings.TrimSpace(statusHelpDescription),
+	}
+}
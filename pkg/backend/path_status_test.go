@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	fail := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Read status
+	status := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      statusPath,
+		Storage:   storage,
+	}
+
+	// Not configured yet
+	resp, err := backend.HandleRequest(ctx, status)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.Equal(t, false, resp.Data["configured"])
+	require.Equal(t, 0, resp.Data["cached_tokens"])
+	require.Nil(t, resp.Data["last_success"])
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":                 "foo",
+			"client_secret":             "bar",
+			"token_url":                 "http://localhost/token",
+			"circuit_breaker_threshold": 1,
+			"circuit_breaker_cooldown":  3600,
+		},
+	}
+
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	// Exchanged tokens are counted as well
+	resp, err = backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      exchangePath + "/user",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"subject_token": "subject",
+		},
+	})
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	resp, err = backend.HandleRequest(ctx, status)
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["configured"])
+	require.Equal(t, 2, resp.Data["cached_tokens"])
+	require.NotNil(t, resp.Data["last_success"])
+	require.Nil(t, resp.Data["last_failure"])
+	require.Equal(t, circuitClosed, resp.Data["circuit_breaker"])
+	require.Nil(t, resp.Data["probe_success"])
+
+	// Probe performs a live token request without caching it
+	status.Data = map[string]interface{}{
+		"probe": true,
+	}
+
+	resp, err = backend.HandleRequest(ctx, status)
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["probe_success"])
+	require.NotEmpty(t, resp.Data["probe_expires"])
+	require.Equal(t, 2, resp.Data["cached_tokens"])
+	require.Equal(t, 3, calls)
+
+	// Failed probe
+	fail = true
+	resp, err = backend.HandleRequest(ctx, status)
+	require.NoError(t, err)
+	require.Equal(t, false, resp.Data["probe_success"])
+	require.Equal(t, "http_503", resp.Data["probe_error"])
+	require.Equal(t, "http_503", resp.Data["last_error"])
+	require.NotNil(t, resp.Data["last_failure"])
+	require.Equal(t, circuitOpen, resp.Data["circuit_breaker"])
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter holds the token bucket limiting upstream token requests. The
+// bucket is rebuilt whenever the configured rate or burst changes.
+type rateLimiter struct {
+	mut     sync.Mutex
+	limiter *rate.Limiter
+	perMin  int
+	burst   int
+}
+
+// get returns the limiter for the given number of requests per minute and
+// burst size, or nil if rate limiting is disabled.
+func (rl *rateLimiter) get(perMin, burst int) *rate.Limiter {
+	if perMin <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = 1
+	}
+
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+
+	if rl.limiter == nil || rl.perMin != perMin || rl.burst != burst {
+		rl.limiter = rate.NewLimiter(rate.Limit(float64(perMin)/time.Minute.Seconds()), burst)
+		rl.perMin = perMin
+		rl.burst = burst
+	}
+
+	return rl.limiter
+}
+
+// waitRateLimit blocks until an upstream token request, queued at the given
+// time, is allowed by the configured rate limit. Requests that would have to
+// wait longer than the configured maximum since they were queued, including
+// the time spent waiting for other requests of the same token, are rejected.
+func (b *backend) waitRateLimit(ctx context.Context, c *config, queued time.Time, labels []metrics.Label) error {
+	lim := b.limiter.get(c.RateLimit, c.RateLimitBurst)
+	if lim == nil {
+		return nil
+	}
+
+	now := b.clock.Now()
+	r := lim.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+
+	if delay > c.RateLimitMaxWait-now.Sub(queued) {
+		r.CancelAt(now)
+		b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "throttled"}, 1, withLabel(labels, "outcome", "rejected"))
+		b.logger.Warn("Token request rejected by rate limit", "delay", delay)
+		return errRateLimited
+	}
+
+	b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "throttled"}, 1, withLabel(labels, "outcome", "queued"))
+
+	if err := b.clock.Sleep(ctx, delay); err != nil {
+		r.CancelAt(b.clock.Now())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenReadRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, calls)))
+	})
+
+	m, sink := newTestMetrics(t)
+
+	storage := &logical.InmemStorage{}
+	backend := new(Options{Metrics: m, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, backend.Setup(ctx, &logical.BackendConfig{}))
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"token_url":     "http://localhost/token",
+			"rate_limit":    1,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+
+	// New token is rejected
+	read.Path = credsPath + "/user2"
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errRateLimited.Error())
+	require.Equal(t, http.StatusTooManyRequests, err.(logical.HTTPCodedError).Code())
+	require.Equal(t, 1, calls)
+	require.Equal(t, 1, counterValue(sink, "oauth.token.throttled;mount=;provider=localhost;outcome=rejected"))
+
+	// Cached token is not affected
+	read.Path = credsPath + "/user"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd1", resp.Data["access_token"])
+}
+
+func TestTokenReadRateLimitQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(fmt.Sprintf(`access_token=abcd%d&token_type=bearer&expires_in=3600`, calls)))
+	})
+
+	m, sink := newTestMetrics(t)
+	clk := &fakeClock{now: time.Now()}
+
+	storage := &logical.InmemStorage{}
+	backend := new(Options{Metrics: m, Clock: clk, Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, backend.Setup(ctx, &logical.BackendConfig{}))
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":           "foo",
+			"client_secret":       "bar",
+			"token_url":           "http://localhost/token",
+			"rate_limit":          60,
+			"rate_limit_max_wait": 5,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+
+	// New token waits for the limiter
+	start := clk.Now()
+	read.Path = credsPath + "/user2"
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd2", resp.Data["access_token"])
+	require.Equal(t, time.Second, clk.Now().Sub(start))
+	require.Equal(t, 1, counterValue(sink, "oauth.token.throttled;mount=;provider=localhost;outcome=queued"))
+}
+
+func TestRateLimitWaitIncludesQueueTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := &fakeClock{now: time.Now()}
+	b := testBackend(clk)
+	c := &config{RateLimit: 60, RateLimitMaxWait: 2 * time.Second}
+
+	require.NoError(t, b.waitRateLimit(ctx, c, clk.Now(), nil))
+
+	// Requests that already waited for another request of the same token
+	// only wait for the rest of the maximum
+	require.Equal(t, errRateLimited, b.waitRateLimit(ctx, c, clk.Now().Add(-1500*time.Millisecond), nil))
+
+	start := clk.Now()
+	require.NoError(t, b.waitRateLimit(ctx, c, start.Add(-500*time.Millisecond), nil))
+	require.Equal(t, time.Second, clk.Now().Sub(start))
+}
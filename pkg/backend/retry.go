@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// retryable reports whether a failed token request may succeed when sent
+// again: network errors, timeouts and 5xx or 429 responses from the token
+// endpoint.
+func retryable(err error) bool {
+	if err == errTokenRequestTimeout {
+		return true
+	}
+
+	var rErr *oauth2.RetrieveError
+	if errors.As(err, &rErr) {
+		code := rErr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+
+	var uErr *url.Error
+	return errors.As(err, &uErr)
+}
+
+// retryAfter returns the delay from the given time requested by the token
+// endpoint through the Retry-After header, given either in seconds or as an
+// HTTP date.
+func retryAfter(err error, now time.Time) (time.Duration, bool) {
+	var rErr *oauth2.RetrieveError
+	if !errors.As(err, &rErr) {
+		return 0, false
+	}
+
+	h := rErr.Response.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(h); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(h); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// backoff returns the delay before the given retry attempt (starting at
+// zero), growing exponentially from min up to max with jitter applied to the
+// upper half of the interval.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+	return d
+}
@@ -0,0 +1,423 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+type FlakyRoundTripper struct {
+	Failures int
+	Err      error
+	Calls    int
+	Next     http.RoundTripper
+}
+
+func (frt *FlakyRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	frt.Calls++
+	if frt.Calls <= frt.Failures {
+		return nil, frt.Err
+	}
+	return frt.Next.RoundTrip(r)
+}
+
+func TestTokenReadRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":         "foo",
+			"client_secret":     "bar",
+			"token_url":         "http://localhost/token",
+			"max_retries":       2,
+			"retry_min_backoff": 0,
+			"retry_max_backoff": 0,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	// Token is retrieved on the third attempt
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+	require.Equal(t, 3, calls)
+
+	// Retries are exhausted
+	calls = 0
+	read.Path = credsPath + "/user2"
+	write.Data["max_retries"] = 1
+
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errTokenEndpointUnavailable.Error())
+	require.Equal(t, http.StatusServiceUnavailable, err.(logical.HTTPCodedError).Code())
+	require.Equal(t, 2, calls)
+}
+
+func TestTokenReadRetriesNetworkErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+	rt := &FlakyRoundTripper{
+		Failures: 1,
+		Err:      errors.New("connection reset by peer"),
+		Next:     &MockRoundTripper{Handler: h},
+	}
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(rt)})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":         "foo",
+			"client_secret":     "bar",
+			"token_url":         "http://localhost/token",
+			"max_retries":       1,
+			"retry_min_backoff": 0,
+			"retry_max_backoff": 0,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+	require.Equal(t, 2, rt.Calls)
+}
+
+func TestTokenReadHonoursRetryAfter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := &fakeClock{now: time.Now()}
+
+	var last time.Time
+	var delay time.Duration
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if last.IsZero() {
+			last = clk.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		delay = clk.Now().Sub(last)
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{
+		Clock:     clk,
+		Transport: staticTransport(&MockRoundTripper{Handler: h}),
+	})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":         "foo",
+			"client_secret":     "bar",
+			"token_url":         "http://localhost/token",
+			"max_retries":       1,
+			"retry_min_backoff": 0,
+			"retry_max_backoff": 5,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "abcd", resp.Data["access_token"])
+	require.Equal(t, time.Second, delay)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":                 "foo",
+			"client_secret":             "bar",
+			"token_url":                 "http://localhost/token",
+			"circuit_breaker_threshold": 2,
+			"circuit_breaker_cooldown":  3600,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Read token
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	// Failures up to the threshold reach the token endpoint
+	for i := 0; i < 2; i++ {
+		_, err = backend.HandleRequest(ctx, read)
+		require.EqualError(t, err, errTokenEndpointUnavailable.Error())
+	}
+	require.Equal(t, 2, calls)
+
+	// Open circuit fast-fails
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errCircuitOpen.Error())
+	require.Equal(t, http.StatusServiceUnavailable, err.(logical.HTTPCodedError).Code())
+	require.Equal(t, 2, calls)
+
+	// Writing config closes the circuit
+	resp, err = backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errTokenEndpointUnavailable.Error())
+	require.Equal(t, 3, calls)
+}
+
+func TestCircuitBreakerRateLimitedTrial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	storage := &logical.InmemStorage{}
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Write new config
+	write := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      configPath,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_id":                 "foo",
+			"client_secret":             "bar",
+			"token_url":                 "http://localhost/token",
+			"circuit_breaker_threshold": 1,
+			"circuit_breaker_cooldown":  0,
+			"rate_limit":                60,
+		},
+	}
+
+	resp, err := backend.HandleRequest(ctx, write)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	_, err = backend.HandleRequest(ctx, read)
+	require.EqualError(t, err, errTokenEndpointUnavailable.Error())
+	upstream := calls
+
+	// Trials rejected by the rate limit don't keep the circuit open
+	for i := 0; i < 2; i++ {
+		_, err = backend.HandleRequest(ctx, read)
+		require.EqualError(t, err, errRateLimited.Error())
+	}
+	require.Equal(t, upstream, calls)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	cb := &circuitBreaker{}
+	now := time.Now()
+
+	require.True(t, cb.allow(1, time.Minute, now))
+	cb.failure(1, now)
+	require.Equal(t, circuitOpen, cb.state(1, time.Minute, now))
+	require.False(t, cb.allow(1, time.Minute, now))
+
+	// Only a single trial request is allowed after the cooldown
+	now = now.Add(time.Minute)
+	require.Equal(t, circuitHalfOpen, cb.state(1, time.Minute, now))
+	require.True(t, cb.allow(1, time.Minute, now))
+	require.False(t, cb.allow(1, time.Minute, now))
+
+	// A trial that never reached the token endpoint is repeated
+	cb.release()
+	require.Equal(t, circuitHalfOpen, cb.state(1, time.Minute, now))
+	require.True(t, cb.allow(1, time.Minute, now))
+
+	// Failed trial re-opens the circuit for another cooldown
+	cb.failure(1, now)
+	require.Equal(t, circuitOpen, cb.state(1, time.Minute, now.Add(time.Minute-time.Second)))
+	require.True(t, cb.allow(1, time.Minute, now.Add(time.Minute)))
+
+	// Successful trial closes the circuit
+	cb.success()
+	require.Equal(t, circuitClosed, cb.state(1, time.Minute, now))
+	require.True(t, cb.allow(1, time.Minute, now))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := backoff(attempt, time.Second, 5*time.Second)
+		require.True(t, d >= max/2 && d <= max, "attempt %d: %s not in [%s, %s]", attempt, d, max/2, max)
+	}
+}
+
+// blockingClock is a fakeClock whose Sleep blocks until released, signalling
+// that it started sleeping.
+type blockingClock struct {
+	fakeClock
+	sleeping chan struct{}
+	release  chan struct{}
+}
+
+func (bc *blockingClock) Sleep(ctx context.Context, d time.Duration) error {
+	bc.sleeping <- struct{}{}
+
+	select {
+	case <-bc.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestTokenRetryUnlocked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("scope") == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`access_token=abcd&token_type=bearer&expires_in=3600`))
+	})
+
+	clk := &blockingClock{
+		fakeClock: fakeClock{now: time.Now()},
+		sleeping:  make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	b := testBackend(clk)
+	b.transport = staticTransport(&MockRoundTripper{Handler: h})
+
+	c := &config{
+		ClientID:        "foo",
+		ClientSecret:    "bar",
+		TokenURL:        "http://localhost/token",
+		MaxRetries:      1,
+		RetryMinBackoff: time.Second,
+		RetryMaxBackoff: time.Second,
+	}
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+
+	failKey, okKey := "creds/fail", "creds/ok"
+	require.NotEqual(t, locksutil.LockIndexForKey(failKey), locksutil.LockIndexForKey(okKey))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := b.getToken(ctx, req, c, &tokenRequest{name: "fail", key: failKey, scopes: scopeSet{"fail"}})
+		errs <- err
+	}()
+
+	// Another token is retrieved while the failing request waits to retry
+	<-clk.sleeping
+	tok, _, err := b.getToken(ctx, req, c, &tokenRequest{name: "ok", key: okKey, scopes: scopeSet{"ok"}})
+	require.NoError(t, err)
+	require.Equal(t, "abcd", tok.AccessToken)
+
+	close(clk.release)
+	require.Error(t, <-errs)
+}
@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const saltPath = "salt"
+
+// getSalt returns the salt of the mount that storage keys are derived from,
+// generating it on first use.
+func (b *backend) getSalt(ctx context.Context, storage logical.Storage) (*salt.Salt, error) {
+	b.saltMut.RLock()
+	if b.salt != nil {
+		defer b.saltMut.RUnlock()
+		return b.salt, nil
+	}
+	b.saltMut.RUnlock()
+
+	b.saltMut.Lock()
+	defer b.saltMut.Unlock()
+
+	if b.salt != nil {
+		return b.salt, nil
+	}
+
+	s, err := salt.NewSalt(ctx, storage, &salt.Config{
+		Location: saltPath,
+		HashFunc: salt.SHA256Hash,
+		HMAC:     sha256.New,
+		HMACType: "hmac-sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.salt = s
+	return s, nil
+}
+
+func (b *backend) invalidate(_ context.Context, key string) {
+	switch key {
+	case saltPath:
+		b.saltMut.Lock()
+		defer b.saltMut.Unlock()
+
+		b.salt = nil
+	}
+}
@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	scopeTemplateEntityID       = "identity.entity.id"
+	scopeTemplateEntityName     = "identity.entity.name"
+	scopeTemplateEntityMetadata = "identity.entity.metadata."
+)
+
+var scopeTemplateRegex = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// scopeError is returned for scopes that can't be requested.
+type scopeError struct {
+	msg string
+}
+
+func (e *scopeError) Error() string {
+	return e.msg
+}
+
+// scopesErrorResponse translates an error from newScopeSet or
+// requestedScopes to the response returned to the client.
+func scopesErrorResponse(err error) (*logical.Response, error) {
+	var sErr *scopeError
+	if errors.As(err, &sErr) {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid scopes: %s", err)), nil
+	}
+
+	return nil, err
+}
+
+// scopeSet is a canonical set of OAuth 2.0 scopes: without whitespace,
+// duplicates or empty scopes, and sorted. The empty set is nil.
+type scopeSet []string
+
+// newScopeSet returns the canonical set of the given scopes without modifying
+// them. Scopes separated by whitespace are split, as they are sent to the token
+// endpoint space-delimited. Scopes that are not valid scope tokens as defined
+// in RFC 6749 section 3.3 are rejected.
+func newScopeSet(scopes []string) (scopeSet, error) {
+	seen := make(map[string]bool, len(scopes))
+
+	var set scopeSet
+	for _, scope := range scopes {
+		for _, token := range strings.Fields(scope) {
+			if !validScopeToken(token) {
+				return nil, &scopeError{fmt.Sprintf("scope %q contains characters not allowed by RFC 6749", token)}
+			}
+
+			if !seen[token] {
+				seen[token] = true
+				set = append(set, token)
+			}
+		}
+	}
+
+	sort.Strings(set)
+	return set, nil
+}
+
+// validScopeToken reports whether token is a valid scope-token as defined in
+// RFC 6749 section 3.3.
+func validScopeToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestedScopes returns the scopes requested in data, or the default scopes
+// from config rendered for the requesting entity if none are requested.
+// Requested scopes must be allowed by config. With allowed scopes configured,
+// an empty override is rejected, as providers usually grant every scope of the
+// client to requests without scopes.
+func (b *backend) requestedScopes(req *logical.Request, c *config, data *framework.FieldData) (scopeSet, error) {
+	if d, ok := data.GetOk("scopes"); ok {
+		if !c.AllowScopeOverride {
+			return nil, &scopeError{"overriding default scopes is not allowed"}
+		}
+
+		set, err := newScopeSet(d.([]string))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(set) == 0 && len(c.AllowedScopes) > 0 {
+			return nil, &scopeError{"at least one scope must be requested when allowed scopes are configured"}
+		}
+
+		for _, scope := range set {
+			if !scopeAllowed(c.AllowedScopes, scope) {
+				return nil, &scopeError{fmt.Sprintf("scope %q does not match any of the allowed scopes", scope)}
+			}
+		}
+
+		return set, nil
+	}
+
+	if !hasScopeTemplates(c.Scopes) {
+		return newScopeSet(c.Scopes)
+	}
+
+	if req.EntityID == "" {
+		return nil, &scopeError{"scope templates require a request associated with an identity entity"}
+	}
+
+	entity, err := b.system().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, err
+	} else if entity == nil {
+		return nil, &scopeError{fmt.Sprintf("entity %q not found", req.EntityID)}
+	}
+
+	rendered := make([]string, len(c.Scopes))
+	for i, scope := range c.Scopes {
+		if rendered[i], err = renderScope(scope, entity); err != nil {
+			return nil, err
+		}
+	}
+
+	return newScopeSet(rendered)
+}
+
+// scopeAllowed reports whether scope matches one of the allowed scope patterns.
+// Any scope is allowed if there are no patterns.
+func scopeAllowed(allowed []string, scope string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, pattern := range allowed {
+		if strutil.GlobbedStringsMatch(pattern, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasScopeTemplates(scopes []string) bool {
+	for _, scope := range scopes {
+		if strings.Contains(scope, "{{") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// untemplatedScopes returns the scopes that don't contain templates.
+func untemplatedScopes(scopes []string) []string {
+	var out []string
+	for _, scope := range scopes {
+		if !strings.Contains(scope, "{{") {
+			out = append(out, scope)
+		}
+	}
+
+	return out
+}
+
+// validateScopeTemplate checks that all templates in scope are well-formed and
+// supported. Scopes are split on whitespace, so templates must not contain
+// any.
+func validateScopeTemplate(scope string) error {
+	if rest := scopeTemplateRegex.ReplaceAllString(scope, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return &scopeError{fmt.Sprintf("scope %q contains a malformed template", scope)}
+	}
+
+	for _, m := range scopeTemplateRegex.FindAllStringSubmatch(scope, -1) {
+		if strings.IndexFunc(m[1], unicode.IsSpace) >= 0 {
+			return &scopeError{fmt.Sprintf("scope %q contains whitespace inside template %q", scope, m[0])}
+		}
+
+		switch path := m[1]; {
+		case path == scopeTemplateEntityID, path == scopeTemplateEntityName:
+		case strings.HasPrefix(path, scopeTemplateEntityMetadata) && len(path) > len(scopeTemplateEntityMetadata):
+		default:
+			return &scopeError{fmt.Sprintf("scope %q contains unsupported template %q", scope, m[0])}
+		}
+	}
+
+	return nil
+}
+
+// renderScope replaces the templates in scope with the identity data of
+// entity. The rendered scope must be a single valid scope token, so that
+// identity data can't add other scopes.
+func renderScope(scope string, entity *logical.Entity) (string, error) {
+	if err := validateScopeTemplate(scope); err != nil {
+		return "", err
+	}
+
+	var err error
+	rendered := scopeTemplateRegex.ReplaceAllStringFunc(scope, func(m string) string {
+		path := m[2 : len(m)-2]
+		switch {
+		case path == scopeTemplateEntityID:
+			return entity.ID
+		case path == scopeTemplateEntityName:
+			return entity.Name
+		default:
+			key := strings.TrimPrefix(path, scopeTemplateEntityMetadata)
+			value, ok := entity.Metadata[key]
+			if !ok && err == nil {
+				err = &scopeError{fmt.Sprintf("scope %q references metadata %q, which is not set on the entity", scope, key)}
+			}
+			return value
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !validScopeToken(rendered) {
+		return "", &scopeError{fmt.Sprintf("scope %q renders to invalid scope %q", scope, rendered)}
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewScopeSet(t *testing.T) {
+	scopes := []string{"b", " a ", "", "a", "c d", "b"}
+
+	set, err := newScopeSet(scopes)
+	require.NoError(t, err)
+	require.Equal(t, scopeSet{"a", "b", "c", "d"}, set)
+
+	// Input is not modified
+	require.Equal(t, []string{"b", " a ", "", "a", "c d", "b"}, scopes)
+
+	// Empty sets are nil
+	set, err = newScopeSet([]string{" ", ""})
+	require.NoError(t, err)
+	require.Nil(t, set)
+
+	// Scope tokens are validated
+	for _, scope := range []string{`a"b`, `a\b`, "é"} {
+		_, err = newScopeSet([]string{scope})
+		require.Error(t, err, scope)
+	}
+
+	set, err = newScopeSet([]string{"https://api.example.com/read", "user:email", "a,b"})
+	require.NoError(t, err)
+	require.Len(t, set, 3)
+}
+
+func TestScopeAllowed(t *testing.T) {
+	allowed := []string{"read", "user:*", "*.read"}
+
+	for _, scope := range []string{"read", "user:email", "user:", "repo.read"} {
+		require.True(t, scopeAllowed(allowed, scope), scope)
+	}
+
+	for _, scope := range []string{"write", "admin", "read.write", "admin.user:email"} {
+		require.False(t, scopeAllowed(allowed, scope), scope)
+	}
+
+	// Any scope is allowed without patterns
+	require.True(t, scopeAllowed(nil, "admin"))
+}
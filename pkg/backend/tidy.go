@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
+)
+
+// tidyPathPrefixes hold tokens cached per subject token or assertion. Every
+// new subject token or assertion gets its own entries, which would otherwise
+// accumulate as they are replaced.
+var tidyPathPrefixes = []string{
+	exchangePathPrefix,
+	jwtBearerPathPrefix,
+}
+
+// periodic removes expired exchanged and JWT bearer tokens. Like storage
+// upgrades, it only runs on nodes that write to the storage of the mount.
+func (b *backend) periodic(ctx context.Context, req *logical.Request) error {
+	if sv := b.system(); sv != nil && !upgradeLocally(sv) {
+		return nil
+	}
+
+	return b.tidyTokens(ctx, req.Storage)
+}
+
+// tokenTidyable reports whether a cached token can no longer be returned at
+// the given time, not even as a stale token. Tokens without an expiry are kept
+// unless default_ttl is configured, as tokenValid then never returns them.
+func tokenTidyable(c *config, tok *oauth2.Token, now time.Time) bool {
+	if tok == nil || tok.AccessToken == "" {
+		return true
+	} else if tok.Expiry.IsZero() {
+		return c.DefaultTTL > 0
+	}
+
+	return !now.Before(tok.Expiry.Add(c.StaleIfError))
+}
+
+// tidyTokens removes expired tokens stored below tidyPathPrefixes.
+func (b *backend) tidyTokens(ctx context.Context, storage logical.Storage) error {
+	c, err := getConfig(ctx, storage)
+	if err != nil {
+		return err
+	} else if c == nil {
+		return nil
+	}
+
+	removed := 0
+	for _, prefix := range tidyPathPrefixes {
+		keys, err := logical.CollectKeysWithPrefix(ctx, storage, prefix)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			ok, err := b.tidyToken(ctx, storage, c, key)
+			if err != nil {
+				return err
+			} else if ok {
+				removed++
+			}
+		}
+	}
+
+	if removed > 0 {
+		b.logger.Debug("Removed expired tokens", "count", removed)
+	}
+
+	return nil
+}
+
+// tidyToken removes the token stored under key if it is expired, reporting
+// whether it was removed.
+func (b *backend) tidyToken(ctx context.Context, storage logical.Storage, c *config, key string) (bool, error) {
+	defer b.lockToken(key)()
+
+	tok, err := getTokenFromStorage(ctx, storage, key)
+	if err != nil {
+		return false, err
+	} else if !tokenTidyable(c, tok, b.clock.Now()) {
+		return false, nil
+	}
+
+	return true, storage.Delete(ctx, key)
+}
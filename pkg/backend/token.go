@@ -0,0 +1,271 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// tokenFunc performs a single request to the token endpoint.
+type tokenFunc func(ctx context.Context) (*oauth2.Token, error)
+
+// refreshTokenFunc returns a tokenFunc that uses the refresh token grant. If
+// the token endpoint rejects the refresh token, the error wraps
+// errRefreshTokenRejected.
+func refreshTokenFunc(c *config, refreshToken string) tokenFunc {
+	oc := &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			TokenURL: c.TokenURL,
+		},
+	}
+
+	return func(ctx context.Context) (*oauth2.Token, error) {
+		// A token without an access token is never valid, so the token
+		// source always refreshes it.
+		tok, err := oc.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+
+		var rErr *oauth2.RetrieveError
+		if errors.As(err, &rErr) && !retryable(err) {
+			return nil, fmt.Errorf("%w: %v", errRefreshTokenRejected, err)
+		}
+
+		return tok, err
+	}
+}
+
+// fetchToken requests a new token from the token endpoint for a request
+// queued at the given time. Transient failures are retried according to the
+// configured backoff and repeated failures open the circuit breaker, which then
+// fast-fails requests until it cools down.
+func (b *backend) fetchToken(ctx context.Context, c *config, fetch tokenFunc, queued time.Time, labels []metrics.Label) (*oauth2.Token, error) {
+	if !b.breaker.allow(c.CircuitBreakerThreshold, c.CircuitBreakerCooldown, b.clock.Now()) {
+		return nil, b.fetchError(c, errCircuitOpen, labels)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Retries are deliberately delayed, so their rate limit wait starts
+		// afresh.
+		if attempt > 0 {
+			queued = b.clock.Now()
+		}
+
+		if err := b.waitRateLimit(ctx, c, queued, labels); err != nil {
+			b.breaker.release()
+			return nil, b.fetchError(c, err, labels)
+		}
+
+		start := time.Now()
+		issued := b.clock.Now()
+		tok, err := requestToken(ctx, c, fetch)
+		b.metrics.MeasureSinceWithLabels([]string{"oauth", "token", "request"}, start, labels)
+		if err == nil {
+			b.breaker.success()
+			b.status.success(b.clock.Now())
+			setTokenLifetime(c, tok, issued)
+			return tok, nil
+		}
+
+		// Refresh tokens expire, so their rejection is expected and not a
+		// failure of the token endpoint, which is reachable.
+		if errors.Is(err, errRefreshTokenRejected) {
+			b.breaker.success()
+			return nil, err
+		}
+
+		if ctx.Err() != nil || !retryable(err) || attempt >= c.MaxRetries {
+			return nil, b.fetchError(c, err, labels)
+		}
+
+		wait, ok := retryAfter(err, b.clock.Now())
+		if !ok {
+			wait = backoff(attempt, c.RetryMinBackoff, c.RetryMaxBackoff)
+		} else if wait > c.RetryMaxBackoff {
+			b.logger.Warn("Token endpoint requested a retry delay longer than allowed", "retry_after", wait)
+			return nil, b.fetchError(c, err, labels)
+		}
+
+		b.logger.Warn("Token request failed, retrying", "attempt", attempt+1, "wait", wait, "error", err)
+
+		if err := b.clock.Sleep(ctx, wait); err != nil {
+			return nil, b.fetchError(c, err, labels)
+		}
+	}
+}
+
+// setTokenLifetime sets the expiry of tok, requested at the given time. The
+// expiry reported by the provider is counted from the start of the request
+// rather than the receipt of the response, checked against the claims of JWT
+// access tokens and shortened by the configured clock_skew, so that tokens are
+// never used after the provider expired them. Tokens without an expiry get the
+// configured default_ttl, and all tokens are shortened to the configured
+// max_ttl, so that they are refreshed and reported as expiring before the
+// provider would expire them.
+func setTokenLifetime(c *config, tok *oauth2.Token, issued time.Time) {
+	if d, ok := tokenExpiresIn(tok); ok {
+		tok.Expiry = issued.Add(d)
+	}
+
+	if exp, ok := jwtExpiry(tok.AccessToken, issued); ok && (tok.Expiry.IsZero() || exp.Before(tok.Expiry)) {
+		tok.Expiry = exp
+	}
+
+	if !tok.Expiry.IsZero() && c.ClockSkew > 0 {
+		tok.Expiry = tok.Expiry.Add(-c.ClockSkew)
+	}
+
+	if tok.Expiry.IsZero() && c.DefaultTTL > 0 {
+		tok.Expiry = issued.Add(c.DefaultTTL)
+	}
+
+	if c.MaxTTL <= 0 {
+		return
+	}
+
+	if max := issued.Add(c.MaxTTL); tok.Expiry.IsZero() || tok.Expiry.After(max) {
+		tok.Expiry = max
+	}
+}
+
+// tokenExpiresIn returns the lifetime of a newly retrieved token as reported
+// in the expires_in parameter of the token response.
+func tokenExpiresIn(tok *oauth2.Token) (time.Duration, bool) {
+	var seconds float64
+	switch v := tok.Extra("expires_in").(type) {
+	case int64:
+		seconds = float64(v)
+	case float64:
+		seconds = v
+	case string:
+		var err error
+		if seconds, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if seconds <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// jwtExpiry returns the expiry of a JWT access token requested at the given
+// time. If the token records when it was issued, its lifetime is counted from
+// the start of the request, so that a clock of the provider running behind
+// ours doesn't extend it. Access tokens that are not JWTs have no expiry.
+func jwtExpiry(accessToken string, issued time.Time) (time.Time, bool) {
+	tok, err := jwt.ParseSigned(accessToken)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	claims := jwt.Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil || claims.Expiry == nil {
+		return time.Time{}, false
+	}
+
+	exp := claims.Expiry.Time()
+	if claims.IssuedAt != nil {
+		if lifetime := exp.Sub(claims.IssuedAt.Time()); issued.Add(lifetime).Before(exp) {
+			exp = issued.Add(lifetime)
+		}
+	}
+
+	return exp, true
+}
+
+// tokenExpiryDelta is how long before its expiry a token is treated as
+// expired, matching golang.org/x/oauth2.
+const tokenExpiryDelta = 10 * time.Second
+
+// tokenValidAt reports whether tok has an access token and is not expired at
+// the given time, like oauth2.Token.Valid.
+func tokenValidAt(tok *oauth2.Token, now time.Time) bool {
+	if tok == nil || tok.AccessToken == "" {
+		return false
+	}
+
+	return tok.Expiry.IsZero() || !tok.Expiry.Add(-tokenExpiryDelta).Before(now)
+}
+
+// tokenValid reports whether tok can be returned at the given time without
+// requesting a new one. With default_ttl configured, tokens without an expiry
+// were stored before it was set and are not trusted to be valid indefinitely.
+// Likewise, tokens expiring later than max_ttl from now were stored before it
+// was lowered.
+func tokenValid(c *config, tok *oauth2.Token, now time.Time) bool {
+	if tok.Expiry.IsZero() && c.DefaultTTL > 0 {
+		return false
+	}
+
+	if c.MaxTTL > 0 && tok.Expiry.After(now.Add(c.MaxTTL)) {
+		return false
+	}
+
+	return tokenValidAt(tok, now)
+}
+
+// requestToken performs a single token request bounded by the configured
+// request timeout.
+func requestToken(ctx context.Context, c *config, fetch tokenFunc) (*oauth2.Token, error) {
+	if c.RequestTimeout <= 0 {
+		return fetch(ctx)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+	defer cancel()
+
+	tok, err := fetch(rctx)
+	if err != nil && ctx.Err() == nil && rctx.Err() == context.DeadlineExceeded {
+		return nil, errTokenRequestTimeout
+	}
+
+	return tok, err
+}
+
+// fetchError records the outcome of a failed token request with the circuit
+// breaker and in metrics, and translates it to the error reported to the
+// caller.
+func (b *backend) fetchError(c *config, err error, labels []metrics.Label) error {
+	code := errorCode(err)
+	b.metrics.IncrCounterWithLabels([]string{"oauth", "token", "error"}, 1, withLabel(labels, "error", code))
+	b.status.failure(code, b.clock.Now())
+
+	return &upstreamError{err: b.translateFetchError(c, err), code: code}
+}
+
+func (b *backend) translateFetchError(c *config, err error) error {
+	if err == errCircuitOpen || err == errRateLimited {
+		return err
+	}
+
+	var rErr *oauth2.RetrieveError
+	if errors.As(err, &rErr) && !retryable(err) {
+		// The token endpoint is reachable, it just refused our request.
+		b.breaker.success()
+		b.logger.Error("Invalid client credentials", "error", rErr)
+		return errInvalidCredentials
+	}
+
+	b.breaker.failure(c.CircuitBreakerThreshold, b.clock.Now())
+
+	if err == errTokenRequestTimeout {
+		b.logger.Error("Token request timed out", "timeout", c.RequestTimeout)
+		return err
+	} else if retryable(err) {
+		b.logger.Error("Token endpoint unavailable", "error", err)
+		return errTokenEndpointUnavailable
+	}
+
+	return err
+}
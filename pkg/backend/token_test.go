@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fc.Add(d)
+	return nil
+}
+
+func (fc *fakeClock) Add(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+func testBackend(clk Clock) *backend {
+	return &backend{
+		credLocks: locksutil.CreateLocks(),
+		logger:    hclog.NewNullLogger(),
+		breaker:   &circuitBreaker{},
+		limiter:   &rateLimiter{},
+		metrics:   globalMetrics{},
+		status:    &fetchStatus{},
+		clock:     clk,
+	}
+}
+
+// slowTokenFunc returns a tokenFunc that takes the given time on clk to
+// return the token response, whose expiry is computed at receipt.
+func slowTokenFunc(clk *fakeClock, d time.Duration, accessToken string, expiresIn float64) tokenFunc {
+	return func(context.Context) (*oauth2.Token, error) {
+		clk.Add(d)
+
+		tok := &oauth2.Token{
+			AccessToken: accessToken,
+			TokenType:   "bearer",
+			Expiry:      clk.Now().Add(time.Duration(expiresIn) * time.Second),
+		}
+		return tok.WithExtra(map[string]interface{}{"expires_in": expiresIn}), nil
+	}
+}
+
+func TestTokenExpiryClockSkew(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Date(2020, 10, 25, 12, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start}
+	b := testBackend(clk)
+
+	// Expiry is counted from the start of the request
+	c := &config{}
+	tok, err := b.fetchToken(ctx, c, slowTokenFunc(clk, 5*time.Second, "abcd", 3600), clk.Now(), nil)
+	require.NoError(t, err)
+	require.Equal(t, start.Add(time.Hour), tok.Expiry)
+
+	// Clock skew is subtracted from the expiry
+	c.ClockSkew = 30 * time.Second
+	start = clk.Now()
+	tok, err = b.fetchToken(ctx, c, slowTokenFunc(clk, 5*time.Second, "abcd", 3600), clk.Now(), nil)
+	require.NoError(t, err)
+	require.Equal(t, start.Add(time.Hour-30*time.Second), tok.Expiry)
+
+	// Tokens are valid until shortly before their expiry by the clock
+	require.True(t, tokenValid(c, tok, start.Add(time.Hour-time.Minute)))
+	require.False(t, tokenValid(c, tok, start.Add(time.Hour-30*time.Second)))
+
+	clk.Add(time.Hour)
+	require.Equal(t, int64(0), tokenTTL(tok, clk.Now()))
+	resp, err := tokenResponse(tok, false, clk.Now())
+	require.NoError(t, err)
+	require.EqualError(t, resp.Error(), "Token expired")
+}
+
+func TestTokenExpiryJWT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Date(2020, 10, 25, 12, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start}
+	b := testBackend(clk)
+	c := &config{}
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	require.NoError(t, err)
+
+	accessToken := func(issuedAt, expiry time.Time) string {
+		claims := jwt.Claims{Expiry: jwt.NewNumericDate(expiry)}
+		if !issuedAt.IsZero() {
+			claims.IssuedAt = jwt.NewNumericDate(issuedAt)
+		}
+
+		tok, err := jwt.Signed(sig).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return tok
+	}
+
+	// The lifetime of the JWT is counted from the start of the request, even
+	// if the clock of the provider runs ahead
+	issuedAt := start.Add(2 * time.Minute)
+	tok, err := b.fetchToken(ctx, c, slowTokenFunc(clk, 0, accessToken(issuedAt, issuedAt.Add(10*time.Minute)), 3600), clk.Now(), nil)
+	require.NoError(t, err)
+	require.WithinDuration(t, start.Add(10*time.Minute), tok.Expiry, 0)
+
+	// An earlier exp claim takes precedence if the JWT has no iat claim
+	tok, err = b.fetchToken(ctx, c, slowTokenFunc(clk, 0, accessToken(time.Time{}, start.Add(5*time.Minute)), 3600), clk.Now(), nil)
+	require.NoError(t, err)
+	require.WithinDuration(t, start.Add(5*time.Minute), tok.Expiry, 0)
+
+	// A shorter expires_in takes precedence over the claims
+	tok, err = b.fetchToken(ctx, c, slowTokenFunc(clk, 0, accessToken(start, start.Add(time.Hour)), 60), clk.Now(), nil)
+	require.NoError(t, err)
+	require.WithinDuration(t, start.Add(time.Minute), tok.Expiry, 0)
+
+	// Opaque access tokens only use expires_in
+	tok, err = b.fetchToken(ctx, c, slowTokenFunc(clk, 0, "a.b.c", 60), clk.Now(), nil)
+	require.NoError(t, err)
+	require.WithinDuration(t, start.Add(time.Minute), tok.Expiry, 0)
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const storageVersionPath = "version"
+
+// storageVersionEntry records the version of the storage layout of a mount.
+// Mounts without it use the original layout, version 0.
+type storageVersionEntry struct {
+	Version int `json:"version"`
+}
+
+// migration upgrades the storage layout by a single version. Migrations must
+// be idempotent, as an interrupted upgrade is repeated on the next
+// initialization.
+type migration func(ctx context.Context, storage logical.Storage) error
+
+// migrations upgrade the storage layout, migrations[i] from version i to
+// version i+1. They must not change once released; later changes to the
+// layout need a new migration.
+var migrations = []migration{
+	migrateConfigDefaults,
+	migrateHMACKeys,
+	migrateAllowScopeOverride,
+}
+
+// storageVersion is the version of the storage layout used by this backend.
+func storageVersion() int {
+	return len(migrations)
+}
+
+func getStorageVersion(ctx context.Context, storage logical.Storage) (int, error) {
+	entry, err := storage.Get(ctx, storageVersionPath)
+	if err != nil {
+		return 0, err
+	} else if entry == nil {
+		return 0, nil
+	}
+
+	v := &storageVersionEntry{}
+	if err := entry.DecodeJSON(v); err != nil {
+		return 0, err
+	}
+
+	return v.Version, nil
+}
+
+// initialize upgrades the storage layout of the mount to the current version
+// and generates its salt.
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	if sv := b.system(); sv != nil && !upgradeLocally(sv) {
+		return nil
+	}
+
+	if err := b.upgrade(ctx, req.Storage); err != nil {
+		return err
+	}
+
+	_, err := b.getSalt(ctx, req.Storage)
+	return err
+}
+
+// upgradeLocally reports whether this node upgrades the storage of the mount.
+// Standbys and DR secondaries can't write to storage, and the storage of
+// replicated mounts on performance secondaries is upgraded by the primary.
+// Local mounts are not replicated, so performance secondaries upgrade them.
+func upgradeLocally(sv logical.SystemView) bool {
+	state := sv.ReplicationState()
+	if state.HasState(consts.ReplicationPerformanceStandby | consts.ReplicationDRSecondary) {
+		return false
+	}
+
+	return sv.LocalMount() || !state.HasState(consts.ReplicationPerformanceSecondary)
+}
+
+func (b *backend) upgrade(ctx context.Context, storage logical.Storage) error {
+	defer b.lockAllTokens()()
+
+	from, err := getStorageVersion(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	to := storageVersion()
+	if from > to {
+		return fmt.Errorf("storage version %d is newer than supported version %d", from, to)
+	} else if from == to {
+		return nil
+	}
+
+	for v := from; v < to; v++ {
+		if err := migrations[v](ctx, storage); err != nil {
+			return fmt.Errorf("failed to upgrade storage from version %d: %w", v, err)
+		}
+
+		entry, err := logical.StorageEntryJSON(storageVersionPath, &storageVersionEntry{Version: v + 1})
+		if err != nil {
+			return err
+		}
+
+		if err := storage.Put(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	b.logger.Info("Upgraded storage", "from", from, "to", to)
+
+	return nil
+}
+
+// migrateConfigDefaults adds the defaults of config fields introduced after
+// the original layout to stored configs, which would otherwise read them as
+// zero.
+func migrateConfigDefaults(ctx context.Context, storage logical.Storage) error {
+	return addConfigDefaults(ctx, storage, map[string]interface{}{
+		"retry_min_backoff":        time.Second,
+		"retry_max_backoff":        30 * time.Second,
+		"circuit_breaker_cooldown": 30 * time.Second,
+		"request_timeout":          30 * time.Second,
+		"rate_limit_burst":         1,
+	})
+}
+
+// migrateAllowScopeOverride keeps scope overrides allowed for stored configs,
+// as they were before the option was introduced.
+func migrateAllowScopeOverride(ctx context.Context, storage logical.Storage) error {
+	return addConfigDefaults(ctx, storage, map[string]interface{}{
+		"allow_scope_override": true,
+	})
+}
+
+// addConfigDefaults sets the stored config fields missing from it to the given
+// defaults.
+func addConfigDefaults(ctx context.Context, storage logical.Storage, defaults map[string]interface{}) error {
+	entry, err := storage.Get(ctx, configPath)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	raw := map[string]interface{}{}
+	if err := entry.DecodeJSON(&raw); err != nil {
+		return err
+	}
+
+	for name, value := range defaults {
+		if _, ok := raw[name]; !ok {
+			raw[name] = value
+		}
+	}
+
+	entry, err = logical.StorageEntryJSON(configPath, raw)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+// migrateHMACKeys removes entries stored under keys derived with unkeyed SHA-1
+// hashes of credential names. The names can't be recovered to derive the new
+// keys, but the entries are recreated on next use: tokens are requested again
+// and DPoP key pairs are generated again.
+func migrateHMACKeys(ctx context.Context, storage logical.Storage) error {
+	for _, prefix := range []string{credsPathPrefix, exchangePathPrefix, jwtBearerPathPrefix, dpopKeysPathPrefix, proxyPathPrefix} {
+		if err := logical.ClearView(ctx, logical.NewStorageView(storage, prefix)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
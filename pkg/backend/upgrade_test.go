@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// loadStorageFixture writes the entries of a fixture in testdata, a JSON
+// object mapping storage keys to values, to storage.
+func loadStorageFixture(ctx context.Context, t *testing.T, storage logical.Storage, name string) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	entries := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal(b, &entries))
+
+	for key, value := range entries {
+		require.NoError(t, storage.Put(ctx, &logical.StorageEntry{Key: key, Value: value}))
+	}
+}
+
+func TestUpgradeFromV0(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`access_token=new&token_type=bearer&expires_in=3600`))
+	})
+
+	storage := &logical.InmemStorage{}
+	loadStorageFixture(ctx, t, storage, "storage-v0.json")
+
+	backend, err := factory(ctx, &logical.BackendConfig{}, Options{Transport: staticTransport(&MockRoundTripper{Handler: h})})
+	require.NoError(t, err)
+
+	// Upgrading twice is the same as upgrading once
+	for i := 0; i < 2; i++ {
+		require.NoError(t, backend.Initialize(ctx, &logical.InitializationRequest{Storage: storage}))
+
+		version, err := getStorageVersion(ctx, storage)
+		require.NoError(t, err)
+		require.Equal(t, storageVersion(), version)
+	}
+
+	// Config has the defaults of newer fields
+	resp, err := backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configPath,
+		Storage:   storage,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "foo", resp.Data["client_id"])
+	require.Equal(t, "http://localhost/token", resp.Data["token_url"])
+	require.Equal(t, int64(1), resp.Data["retry_min_backoff"])
+	require.Equal(t, int64(30), resp.Data["retry_max_backoff"])
+	require.Equal(t, int64(30), resp.Data["request_timeout"])
+	require.Equal(t, 1, resp.Data["rate_limit_burst"])
+	require.Equal(t, true, resp.Data["allow_scope_override"])
+
+	cfg, err := getConfig(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, "bar", cfg.ClientSecret)
+
+	// Tokens stored under SHA-1 keys are removed
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, credsPathPrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// Salt is generated
+	entry, err := storage.Get(ctx, saltPath)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+
+	// New tokens are requested and stored under HMAC keys
+	read := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      credsPath + "/user",
+		Storage:   storage,
+	}
+
+	resp, err = backend.HandleRequest(ctx, read)
+	require.NoError(t, err)
+	require.False(t, resp != nil && resp.IsError(), "response with error: %+v", resp.Error())
+	require.Equal(t, "new", resp.Data["access_token"])
+
+	keys, err = logical.CollectKeysWithPrefix(ctx, storage, credsPathPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.NotContains(t, keys[0], "12de/a96f")
+}
+
+func TestUpgradeNewerVersion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	storage := &logical.InmemStorage{}
+	entry, err := logical.StorageEntryJSON(storageVersionPath, &storageVersionEntry{Version: storageVersion() + 1})
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(ctx, entry))
+
+	backend, err := Factory(ctx, &logical.BackendConfig{})
+	require.NoError(t, err)
+
+	err = backend.Initialize(ctx, &logical.InitializationRequest{Storage: storage})
+	require.Error(t, err)
+}
+
+func TestUpgradeReplication(t *testing.T) {
+	tests := []struct {
+		state   consts.ReplicationState
+		local   bool
+		upgrade bool
+	}{
+		{state: 0, upgrade: true},
+		{state: consts.ReplicationPerformancePrimary, upgrade: true},
+		{state: consts.ReplicationPerformanceSecondary, upgrade: false},
+		{state: consts.ReplicationPerformanceSecondary, local: true, upgrade: true},
+		{state: consts.ReplicationPerformanceStandby, upgrade: false},
+		{state: consts.ReplicationPerformanceStandby, local: true, upgrade: false},
+		{state: consts.ReplicationDRSecondary, local: true, upgrade: false},
+	}
+
+	for _, test := range tests {
+		sv := &logical.StaticSystemView{ReplicationStateVal: test.state, LocalMountVal: test.local}
+		require.Equal(t, test.upgrade, upgradeLocally(sv), "state %v, local %t", test.state, test.local)
+	}
+}